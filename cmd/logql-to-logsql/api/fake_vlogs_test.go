@@ -0,0 +1,356 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// transportErrors records failures of fake VictoriaLogs transports.
+//
+// Range queries may be sent from other goroutines, where t.Fatalf must not be called,
+// so the failures are checked after the request is served.
+type transportErrors struct {
+	mu   sync.Mutex
+	errs []string
+}
+
+// fail records the failure and returns the error response.
+func (te *transportErrors) fail(format string, args ...any) (*http.Response, error) {
+	msg := fmt.Sprintf(format, args...)
+	te.mu.Lock()
+	te.errs = append(te.errs, msg)
+	te.mu.Unlock()
+	return &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(bytes.NewBufferString(msg)),
+		Header:     make(http.Header),
+	}, nil
+}
+
+func (te *transportErrors) check(t *testing.T) {
+	t.Helper()
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if len(te.errs) > 0 {
+		t.Fatalf("unexpected requests to VictoriaLogs:\n%s", strings.Join(te.errs, "\n"))
+	}
+}
+
+// fakeRateVictoriaLogs evaluates translated range and instant queries over fixture logs with the given offsets in seconds from base.
+// The message of the i-th log has i+1 bytes.
+//
+// It supports only the pipes used by sum(rate()), sum(count_over_time()) and sum(bytes_rate()) evaluated at all the points
+// of a range query or at the instant query time: stats optionally grouped by `_time` buckets, math, format, unroll, filter and delete.
+// The rate is calculated over rangeSeconds, which must match the divisor in the query; it is zero for queries without the divisor.
+func fakeRateVictoriaLogs(te *transportErrors, base time.Time, offsets []int, rangeSeconds int) roundTripperFunc {
+	windowRe := regexp.MustCompile(`_time:\(([^,]+), ([^\]]+)\]`)
+	divisorRe := regexp.MustCompile(`\| math \(value / (\d+)\) as value`)
+	return func(req *http.Request) (*http.Response, error) {
+		instant := req.URL.Path == "/select/logsql/stats_query"
+		if req.URL.Path != "/select/logsql/query" && !instant {
+			return te.fail("unexpected path: %s", req.URL.Path)
+		}
+		if err := req.ParseForm(); err != nil {
+			return te.fail("failed to parse form: %v", err)
+		}
+		query := req.Form.Get("query")
+		divisor := ""
+		if m := divisorRe.FindStringSubmatch(query); m != nil {
+			divisor = m[1]
+		}
+		if rangeSeconds != 0 && divisor != strconv.Itoa(rangeSeconds) || rangeSeconds == 0 && divisor != "" {
+			return te.fail("unexpected rate divisor %q in query %q; want %d", divisor, query, rangeSeconds)
+		}
+
+		pipes := strings.Split(query, " | ")
+		windows := windowRe.FindAllStringSubmatch(pipes[0], -1)
+		if len(windows) == 0 {
+			return te.fail("missing time filter in query %q", query)
+		}
+		var rows []map[string]string
+		for i, off := range offsets {
+			ts := base.Add(time.Duration(off) * time.Second)
+			for _, w := range windows {
+				start, _ := time.Parse(time.RFC3339Nano, w[1])
+				end, _ := time.Parse(time.RFC3339Nano, w[2])
+				if ts.After(start) && !ts.After(end) {
+					rows = append(rows, map[string]string{"_time": ts.UTC().Format(time.RFC3339Nano), "_msg": strings.Repeat("x", i+1)})
+					break
+				}
+			}
+		}
+		for _, pipe := range pipes[1:] {
+			var err error
+			if rows, err = fakePipe(rows, pipe); err != nil {
+				return te.fail("cannot evaluate %q in query %q: %v", pipe, query, err)
+			}
+		}
+
+		var body string
+		if instant {
+			body, err := fakeStatsQueryResponse(rows, req.Form.Get("time"))
+			if err != nil {
+				return te.fail("cannot build response for query %q: %v", query, err)
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}, nil
+		}
+		for _, row := range rows {
+			line, _ := json.Marshal(row)
+			body += string(line) + "\n"
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}, nil
+	}
+}
+
+// fakeStatsQueryResponse returns the response of VictoriaLogs stats_query endpoint with the stats rows evaluated at t.
+func fakeStatsQueryResponse(rows []map[string]string, t string) (string, error) {
+	ts, err := time.Parse(time.RFC3339Nano, t)
+	if err != nil {
+		return "", err
+	}
+	type sample struct {
+		Metric map[string]string `json:"metric"`
+		Value  []any             `json:"value"`
+	}
+	result := []sample{}
+	for _, row := range rows {
+		metric := map[string]string{"__name__": "value"}
+		for k, v := range row {
+			if k != "value" {
+				metric[k] = v
+			}
+		}
+		result = append(result, sample{Metric: metric, Value: []any{ts.Unix(), row["value"]}})
+	}
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string   `json:"resultType"`
+			Result     []sample `json:"result"`
+		} `json:"data"`
+	}
+	resp.Status = "success"
+	resp.Data.ResultType = "vector"
+	resp.Data.Result = result
+	body, err := json.Marshal(resp)
+	return string(body), err
+}
+
+var (
+	fakeStatsRe  = regexp.MustCompile(`^stats (?:by \(([^)]*)\) )?(count\(\)|sum_len\(_msg\)|sum\(value\)) as value$`)
+	fakeBucketRe = regexp.MustCompile(`^_time:(\S+) offset (\d+)ns$`)
+	fakeMathRe   = regexp.MustCompile(`^math (.+) as (\w+)$`)
+	fakeFormatRe = regexp.MustCompile(`^format "([^"]*)" as (\w+)$`)
+	fakeUnrollRe = regexp.MustCompile(`^unroll by \((\w+)\)$`)
+	fakeFilterRe = regexp.MustCompile(`^(\w+):(<=|>=)(-?\d+)$`)
+)
+
+// fakePipe applies the LogsQL pipe to rows the same way as VictoriaLogs does.
+func fakePipe(rows []map[string]string, pipe string) ([]map[string]string, error) {
+	switch {
+	case fakeStatsRe.MatchString(pipe):
+		m := fakeStatsRe.FindStringSubmatch(pipe)
+		var by []string
+		if m[1] != "" {
+			by = strings.Split(m[1], ", ")
+		}
+		var keys []string
+		groups := make(map[string]map[string]string)
+		values := make(map[string]float64)
+		for _, row := range rows {
+			group := make(map[string]string)
+			for _, field := range by {
+				bm := fakeBucketRe.FindStringSubmatch(field)
+				if bm == nil {
+					group[field] = row[field]
+					continue
+				}
+				step, err := time.ParseDuration(bm[1])
+				if err != nil {
+					return nil, err
+				}
+				offset, _ := strconv.ParseInt(bm[2], 10, 64)
+				ts, err := time.Parse(time.RFC3339Nano, row["_time"])
+				if err != nil {
+					return nil, err
+				}
+				n := ts.UnixNano() - offset
+				group["_time"] = time.Unix(0, n-((n%int64(step))+int64(step))%int64(step)+offset).UTC().Format(time.RFC3339Nano)
+			}
+			key, _ := json.Marshal(group)
+			if _, ok := groups[string(key)]; !ok {
+				keys = append(keys, string(key))
+				groups[string(key)] = group
+			}
+			switch m[2] {
+			case "count()":
+				values[string(key)]++
+			case "sum_len(_msg)":
+				values[string(key)] += float64(len(row["_msg"]))
+			default:
+				v, err := strconv.ParseFloat(row["value"], 64)
+				if err != nil {
+					return nil, err
+				}
+				values[string(key)] += v
+			}
+		}
+		var out []map[string]string
+		for _, key := range keys {
+			group := groups[key]
+			group["value"] = strconv.FormatFloat(values[key], 'f', -1, 64)
+			out = append(out, group)
+		}
+		return out, nil
+	case fakeMathRe.MatchString(pipe):
+		m := fakeMathRe.FindStringSubmatch(pipe)
+		expr, err := parser.ParseExpr(m[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			v, err := fakeMath(expr, row)
+			if err != nil {
+				return nil, err
+			}
+			row[m[2]] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return rows, nil
+	case fakeFormatRe.MatchString(pipe):
+		m := fakeFormatRe.FindStringSubmatch(pipe)
+		for _, row := range rows {
+			row[m[2]] = m[1]
+		}
+		return rows, nil
+	case fakeUnrollRe.MatchString(pipe):
+		field := fakeUnrollRe.FindStringSubmatch(pipe)[1]
+		var out []map[string]string
+		for _, row := range rows {
+			var items []float64
+			if err := json.Unmarshal([]byte(row[field]), &items); err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				r := maps.Clone(row)
+				r[field] = strconv.FormatFloat(item, 'f', -1, 64)
+				out = append(out, r)
+			}
+		}
+		return out, nil
+	case strings.HasPrefix(pipe, "filter "):
+		var out []map[string]string
+	rowsLoop:
+		for _, row := range rows {
+			for _, cond := range strings.Fields(strings.TrimPrefix(pipe, "filter ")) {
+				m := fakeFilterRe.FindStringSubmatch(cond)
+				if m == nil {
+					return nil, fmt.Errorf("unsupported filter %q", cond)
+				}
+				v, _ := strconv.ParseFloat(row[m[1]], 64)
+				limit, _ := strconv.ParseFloat(m[3], 64)
+				if m[2] == "<=" && v > limit || m[2] == ">=" && v < limit {
+					continue rowsLoop
+				}
+			}
+			out = append(out, row)
+		}
+		return out, nil
+	case strings.HasPrefix(pipe, "delete "):
+		for _, row := range rows {
+			for _, field := range strings.Split(strings.TrimPrefix(pipe, "delete "), ", ") {
+				delete(row, field)
+			}
+		}
+		return rows, nil
+	default:
+		return nil, fmt.Errorf("unsupported pipe")
+	}
+}
+
+// fakeMath evaluates the LogsQL math expression, which is parsed as Go expression, over the row.
+//
+// Fields are converted to numbers the same way as VictoriaLogs does: RFC3339 timestamps are converted to nanoseconds.
+func fakeMath(expr ast.Expr, row map[string]string) (float64, error) {
+	switch e := expr.(type) {
+	case *ast.ParenExpr:
+		return fakeMath(e.X, row)
+	case *ast.BasicLit:
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		if v, err := strconv.ParseFloat(row[e.Name], 64); err == nil {
+			return v, nil
+		}
+		ts, err := time.Parse(time.RFC3339Nano, row[e.Name])
+		if err != nil {
+			return 0, fmt.Errorf("field %s isn't a number: %q", e.Name, row[e.Name])
+		}
+		return float64(ts.UnixNano()), nil
+	case *ast.BinaryExpr:
+		x, err := fakeMath(e.X, row)
+		if err != nil {
+			return 0, err
+		}
+		y, err := fakeMath(e.Y, row)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			return x / y, nil
+		}
+	case *ast.CallExpr:
+		var args []float64
+		for _, arg := range e.Args {
+			v, err := fakeMath(arg, row)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, v)
+		}
+		switch fmt.Sprint(e.Fun) {
+		case "abs":
+			return math.Abs(args[0]), nil
+		case "round":
+			return math.Round(args[0]), nil
+		case "ceil":
+			return math.Ceil(args[0]), nil
+		case "max":
+			return math.Max(args[0], args[1]), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported math expression %T", expr)
+}
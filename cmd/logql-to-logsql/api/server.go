@@ -24,11 +24,24 @@ type Config struct {
 	Endpoint    string `json:"endpoint"`
 	BearerToken string `json:"bearerToken"`
 	Limit       uint32 `json:"limit"`
+	// LabelMapping maps LogQL label names to VictoriaLogs field names.
+	LabelMapping *logsql.LabelMapping `json:"labelMapping,omitempty"`
+	// StreamFields contains VictoriaLogs `_stream` fields. Stream selector matchers on other labels are translated into field filters.
+	StreamFields []string `json:"streamFields,omitempty"`
+	// DetectStreamFields enables looking up `_stream` fields at the VictoriaLogs endpoint instead of using StreamFields.
+	DetectStreamFields bool `json:"detectStreamFields,omitempty"`
+	// LineFilterMode defines the translation of `|=` and `!=` line filters: word (default) or substring.
+	LineFilterMode logsql.LineFilterMode `json:"lineFilterMode,omitempty"`
+	// PerPointEvaluation enables evaluating range metric queries, which cannot be evaluated by a single VictoriaLogs query,
+	// by a query per point.
+	PerPointEvaluation bool `json:"perPointEvaluation,omitempty"`
 }
 
 type Server struct {
-	api *vlogs.API
-	mux *http.ServeMux
+	api                *vlogs.API
+	translator         *logsql.Translator
+	detectStreamFields bool
+	mux                *http.ServeMux
 }
 
 func NewServer(cfg Config) (*Server, error) {
@@ -41,8 +54,19 @@ func NewServer(cfg Config) (*Server, error) {
 		}
 	}
 
+	translator, err := logsql.NewTranslator(logsql.Options{
+		LabelMapping:   serverCfg.LabelMapping,
+		StreamFields:   serverCfg.StreamFields,
+		LineFilterMode: serverCfg.LineFilterMode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid translation options: %w", err)
+	}
+
 	srv := &Server{
-		mux: http.NewServeMux(),
+		translator:         translator,
+		detectStreamFields: serverCfg.DetectStreamFields,
+		mux:                http.NewServeMux(),
 		api: vlogs.NewVLogsAPI(
 			vlogs.EndpointConfig{
 				Endpoint:    serverCfg.Endpoint,
@@ -51,6 +75,7 @@ func NewServer(cfg Config) (*Server, error) {
 			serverCfg.Limit,
 		),
 	}
+	srv.api.SetPerPointEvaluation(serverCfg.PerPointEvaluation)
 	srv.mux.HandleFunc("/healthz", withSecurityHeaders(srv.handleHealth))
 	srv.mux.HandleFunc("/api/v1/logql-to-logsql", withSecurityHeaders(srv.handleQuery))
 	srv.mux.HandleFunc("/api/v1/config", withSecurityHeaders(func(w http.ResponseWriter, r *http.Request) {
@@ -88,13 +113,15 @@ type queryRequest struct {
 	BearerToken string `json:"bearerToken,omitempty"`
 	Start       string `json:"start,omitempty"`
 	End         string `json:"end,omitempty"`
+	Step        string `json:"step,omitempty"`
 	ExecMode    string `json:"execMode,omitempty"`
 }
 
 type queryResponse struct {
-	LogsQL string `json:"logsql"`
-	Data   string `json:"data,omitempty"`
-	Error  string `json:"error,omitempty"`
+	LogsQL   string   `json:"logsql"`
+	Warnings []string `json:"warnings,omitempty"`
+	Data     string   `json:"data,omitempty"`
+	Error    string   `json:"error,omitempty"`
 }
 
 func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
@@ -124,8 +151,38 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 	}
 	start := strings.TrimSpace(req.Start)
 	end := strings.TrimSpace(req.End)
+	step := strings.TrimSpace(req.Step)
+
+	params := vlogs.RequestParams{
+		EndpointConfig: vlogs.EndpointConfig{
+			Endpoint:    req.Endpoint,
+			BearerToken: req.BearerToken,
+		},
+		Start:    start,
+		End:      end,
+		Step:     step,
+		ExecMode: execMode,
+	}
 
-	qi, err := logsql.TranslateLogQLToLogsQL(logqlText)
+	translator := s.translator
+	if s.detectStreamFields {
+		fields, err := s.api.StreamFieldNames(r.Context(), params)
+		if err != nil {
+			log.Printf("ERROR: failed to get stream fields: %v", err)
+			var ae *vlogs.APIError
+			if errors.As(err, &ae) {
+				writeJSON(w, ae.Code, queryResponse{Error: ae.Message})
+			} else {
+				writeJSON(w, http.StatusBadGateway, queryResponse{Error: "failed to get stream fields"})
+			}
+			return
+		}
+		if fields != nil {
+			translator = translator.WithStreamFields(fields)
+		}
+	}
+
+	qi, err := translator.Translate(logqlText)
 	if err != nil {
 		log.Printf("ERROR: query translation failed: %v", err)
 		var ae *vlogs.APIError
@@ -140,16 +197,8 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := queryResponse{LogsQL: qi.LogsQL}
-	data, err := s.api.Execute(r.Context(), qi, vlogs.RequestParams{
-		EndpointConfig: vlogs.EndpointConfig{
-			Endpoint:    req.Endpoint,
-			BearerToken: req.BearerToken,
-		},
-		Start:    start,
-		End:      end,
-		ExecMode: execMode,
-	})
+	resp := queryResponse{LogsQL: qi.LogsQL, Warnings: qi.Warnings}
+	data, err := s.api.Execute(r.Context(), qi, params)
 	if err != nil {
 		log.Printf("ERROR: query execution failed: %v", err)
 		var ae *vlogs.APIError
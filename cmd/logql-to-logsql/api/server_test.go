@@ -6,14 +6,16 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
-)
-
-type roundTripperFunc func(*http.Request) (*http.Response, error)
+	"time"
 
-func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
-	return f(req)
-}
+	"github.com/VictoriaMetrics-Community/logql-to-logsql/lib/logsql"
+)
 
 func TestHandleQueryLogsSuccess(t *testing.T) {
 	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
@@ -80,31 +82,32 @@ func TestHandleQueryLogsSuccess(t *testing.T) {
 	}
 }
 
-func TestHandleQueryStatsRangeSuccess(t *testing.T) {
-	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+func TestHandleQueryStatsRangePerPoint(t *testing.T) {
+	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000, PerPointEvaluation: true})
 	if err != nil {
 		t.Fatalf("NewServer error: %v", err)
 	}
+	var te transportErrors
+	var mu sync.Mutex
+	queries := make(map[string]string)
 	srv.setHTTPClient(&http.Client{
 		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
-			if req.URL.Path != "/select/logsql/stats_query_range" {
-				t.Fatalf("unexpected path: %s", req.URL.Path)
+			if req.URL.Path != "/select/logsql/stats_query" {
+				return te.fail("unexpected path: %s", req.URL.Path)
 			}
 			if err := req.ParseForm(); err != nil {
-				t.Fatalf("failed to parse form: %v", err)
-			}
-			if got := req.Form.Get("query"); got != `{app="nginx"} _time:5m | stats by (_stream) rate() as value` {
-				t.Fatalf("unexpected query sent: %q", got)
+				return te.fail("failed to parse form: %v", err)
 			}
-			if got := req.Form.Get("start"); got != "1" {
-				t.Fatalf("unexpected start sent: %q", got)
-			}
-			if got := req.Form.Get("end"); got != "2" {
-				t.Fatalf("unexpected end sent: %q", got)
+			mu.Lock()
+			queries[req.Form.Get("time")] = req.Form.Get("query")
+			mu.Unlock()
+			body := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"value","app":"nginx"},"value":[0,"0.5"]}]}}`
+			if req.Form.Get("time") == "2023-11-14T22:18:20Z" {
+				body = `{"status":"success","data":{"resultType":"vector","result":[]}}`
 			}
 			resp := &http.Response{
 				StatusCode: http.StatusOK,
-				Body:       io.NopCloser(bytes.NewBufferString(`{"status":"success"}`)),
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
 				Header:     make(http.Header),
 			}
 			resp.Header.Set("Content-Type", "application/json")
@@ -113,9 +116,10 @@ func TestHandleQueryStatsRangeSuccess(t *testing.T) {
 	})
 
 	reqBody := map[string]string{
-		"logql": `rate({app="nginx"}[5m])`,
-		"start": "1",
-		"end":   "2",
+		"logql": `first_over_time({app="nginx"} | unwrap latency [10m] offset 1m)`,
+		"start": "1700000000",
+		"end":   "1700000600",
+		"step":  "300",
 	}
 	buf, _ := json.Marshal(reqBody)
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
@@ -124,8 +128,9 @@ func TestHandleQueryStatsRangeSuccess(t *testing.T) {
 	rr := httptest.NewRecorder()
 	srv.ServeHTTP(rr, req)
 
+	te.check(t)
 	if rr.Code != http.StatusOK {
-		t.Fatalf("expected status 200, got %d", rr.Code)
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
 	}
 	var resp struct {
 		LogsQL string `json:"logsql"`
@@ -134,11 +139,176 @@ func TestHandleQueryStatsRangeSuccess(t *testing.T) {
 	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
 		t.Fatalf("invalid json response: %v", err)
 	}
-	if resp.LogsQL != `{app="nginx"} _time:5m | stats by (_stream) rate() as value` {
+	if resp.LogsQL != `{app="nginx"} _time:10m offset 1m | first 1 (_time) partition by (_stream) | stats by (_stream) max(latency) as value` {
 		t.Fatalf("unexpected LogsQL: %s", resp.LogsQL)
 	}
-	if resp.Data != `{"status":"success"}` {
-		t.Fatalf("unexpected victoria payload: %s", resp.Data)
+	expectedQueries := map[string]string{
+		"2023-11-14T22:13:20Z": `{app="nginx"} _time:(2023-11-14T22:02:20Z, 2023-11-14T22:12:20Z] | first 1 (_time) partition by (_stream) | stats by (_stream) max(latency) as value`,
+		"2023-11-14T22:18:20Z": `{app="nginx"} _time:(2023-11-14T22:07:20Z, 2023-11-14T22:17:20Z] | first 1 (_time) partition by (_stream) | stats by (_stream) max(latency) as value`,
+		"2023-11-14T22:23:20Z": `{app="nginx"} _time:(2023-11-14T22:12:20Z, 2023-11-14T22:22:20Z] | first 1 (_time) partition by (_stream) | stats by (_stream) max(latency) as value`,
+	}
+	if len(queries) != len(expectedQueries) {
+		t.Fatalf("unexpected queries sent: %v", queries)
+	}
+	for ts, q := range expectedQueries {
+		if queries[ts] != q {
+			t.Fatalf("unexpected query sent at %s: %q", ts, queries[ts])
+		}
+	}
+	expected := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"value","app":"nginx"},"values":[[1700000000,"0.5"],[1700000600,"0.5"]]}]}}`
+	if resp.Data != expected {
+		t.Fatalf("unexpected data: %s", resp.Data)
+	}
+}
+
+func TestHandleQueryStatsRangePerPointDisabled(t *testing.T) {
+	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	var te transportErrors
+	srv.setHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return te.fail("unexpected HTTP call to VictoriaLogs: %s", req.URL.Path)
+		}),
+	})
+
+	reqBody := map[string]string{
+		"logql": `first_over_time({app="nginx"} | unwrap latency [10m])`,
+		"start": "1700000000",
+		"end":   "1700000600",
+		"step":  "300",
+	}
+	buf, _ := json.Marshal(reqBody)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	te.check(t)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "per-point evaluation is disabled; enable it with the perPointEvaluation config option") {
+		t.Fatalf("unexpected error: %s", rr.Body.String())
+	}
+}
+
+func TestHandleQueryStatsInstantAtEnd(t *testing.T) {
+	for _, start := range []string{"", "1700000600"} {
+		srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+		if err != nil {
+			t.Fatalf("NewServer error: %v", err)
+		}
+		var te transportErrors
+		var queries, times []string
+		srv.setHTTPClient(&http.Client{
+			Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Path != "/select/logsql/stats_query" {
+					return te.fail("unexpected path: %s", req.URL.Path)
+				}
+				if err := req.ParseForm(); err != nil {
+					return te.fail("failed to parse form: %v", err)
+				}
+				queries = append(queries, req.Form.Get("query"))
+				times = append(times, req.Form.Get("time"))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(bytes.NewBufferString(`{"status":"success","data":{"resultType":"vector","result":[]}}`)),
+					Header:     make(http.Header),
+				}, nil
+			}),
+		})
+
+		reqBody := map[string]string{
+			"logql": `rate({app="nginx"}[5m] offset 1m)`,
+			"start": start,
+			"end":   "1700000600",
+		}
+		buf, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		te.check(t)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for start %q, got %d: %s", start, rr.Code, rr.Body.String())
+		}
+		expectedQuery := `{app="nginx"} _time:(2023-11-14T22:17:20Z, 2023-11-14T22:22:20Z] | stats by (_stream) count() as value | math (value / 300) as value`
+		if len(queries) != 1 || queries[0] != expectedQuery {
+			t.Fatalf("unexpected queries sent for start %q: %q", start, queries)
+		}
+		if times[0] != "2023-11-14T22:23:20Z" {
+			t.Fatalf("unexpected time sent for start %q: %q", start, times[0])
+		}
+	}
+}
+
+func TestHandleQueryStatsRangeSingleQuery(t *testing.T) {
+	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	var te transportErrors
+	var mu sync.Mutex
+	var queries []string
+	srv.setHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "/select/logsql/query" {
+				return te.fail("unexpected path: %s", req.URL.Path)
+			}
+			if err := req.ParseForm(); err != nil {
+				return te.fail("failed to parse form: %v", err)
+			}
+			mu.Lock()
+			queries = append(queries, req.Form.Get("query"))
+			mu.Unlock()
+			// Rows aren't ordered by point.
+			body := `{"_point":"2","_stream":"{app=\"nginx\"}","value":"0.25"}` + "\n" +
+				`{"_point":"0","_stream":"{app=\"nginx\"}","value":"0.5"}` + "\n"
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}, nil
+		}),
+	})
+
+	reqBody := map[string]string{
+		"logql": `rate({app="nginx"}[5m] offset 1m)`,
+		"start": "1700000000",
+		"end":   "1700000600",
+		"step":  "300",
+	}
+	buf, _ := json.Marshal(reqBody)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	te.check(t)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	// Windows of adjacent points are merged, and every bucket starts right after the window of the previous point.
+	expectedQuery := `{app="nginx"} _time:(2023-11-14T22:07:20Z, 2023-11-14T22:22:20Z] | stats by (_time:5m offset 140000000001ns, _stream) count() as value` +
+		` | math abs(round((_time - 1699999640000000001) / 300000000000)) as _point | delete _time | math (value / 300) as value`
+	if len(queries) != 1 || queries[0] != expectedQuery {
+		t.Fatalf("unexpected queries sent: %q", queries)
+	}
+	expected := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"value","_stream":"{app=\"nginx\"}"},"values":[[1700000000,"0.5"],[1700000600,"0.25"]]}]}}`
+	if resp.Data != expected {
+		t.Fatalf("unexpected data: %s", resp.Data)
 	}
 }
 
@@ -182,3 +352,348 @@ func TestHandleQueryTranslateOnlySkipsVictoria(t *testing.T) {
 		t.Fatalf("expected empty data, got: %q", resp.Data)
 	}
 }
+
+func TestHandleQueryConstantSkipsVictoria(t *testing.T) {
+	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	srv.setHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			t.Fatalf("unexpected HTTP call to VictoriaLogs: %s", req.URL.Path)
+			return nil, nil
+		}),
+	})
+
+	reqBody := map[string]string{
+		"logql": `vector(1) + vector(1)`,
+		"start": "1700000000",
+		"end":   "1700007200",
+		"step":  "1h",
+	}
+	buf, _ := json.Marshal(reqBody)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	var resp struct {
+		LogsQL string `json:"logsql"`
+		Data   string `json:"data"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	expected := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"value"},"values":[[1700000000,"2"],[1700003600,"2"],[1700007200,"2"]]}]}}`
+	if resp.Data != expected {
+		t.Fatalf("unexpected data: %s", resp.Data)
+	}
+}
+
+func TestHandleQueryLabelMapping(t *testing.T) {
+	srv, err := NewServer(Config{LabelMapping: &logsql.LabelMapping{Preset: "vector"}})
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+
+	reqBody := map[string]string{
+		"logql":    `{namespace="prod", pod="api-0"} |= "error"`,
+		"execMode": "translate",
+	}
+	buf, _ := json.Marshal(reqBody)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	var resp struct {
+		LogsQL string `json:"logsql"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if resp.LogsQL != `{kubernetes.pod_namespace="prod",kubernetes.pod_name="api-0"} "error"` {
+		t.Fatalf("unexpected LogsQL: %s", resp.LogsQL)
+	}
+}
+
+func TestNewServerInvalidLabelMapping(t *testing.T) {
+	if _, err := NewServer(Config{LabelMapping: &logsql.LabelMapping{Preset: "unknown"}}); err == nil {
+		t.Fatalf("expected error for unknown label mapping preset")
+	}
+}
+
+func TestHandleQueryDetectStreamFields(t *testing.T) {
+	srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000, DetectStreamFields: true})
+	if err != nil {
+		t.Fatalf("NewServer error: %v", err)
+	}
+	te := &transportErrors{}
+	var lookups, queries atomic.Int32
+	var mu sync.Mutex
+	var lookupRanges []string
+	srv.setHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := req.ParseForm(); err != nil {
+				return te.fail("failed to parse form: %v", err)
+			}
+			body := ""
+			switch req.URL.Path {
+			case "/select/logsql/stream_field_names":
+				lookups.Add(1)
+				mu.Lock()
+				lookupRanges = append(lookupRanges, req.Form.Get("start")+" "+req.Form.Get("end"))
+				mu.Unlock()
+				body = `{"values":[{"value":"app","hits":10}]}`
+			case "/select/logsql/query":
+				queries.Add(1)
+				if query := req.Form.Get("query"); query != `{app="nginx"} level:=error` {
+					return te.fail("unexpected query: %s", query)
+				}
+				body = `{"_msg":"error"}`
+			default:
+				return te.fail("unexpected path: %s", req.URL.Path)
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewBufferString(body)),
+				Header:     make(http.Header),
+			}
+			resp.Header.Set("Content-Type", "application/json")
+			return resp, nil
+		}),
+	})
+
+	for _, tc := range []struct {
+		execMode   string
+		start, end string
+	}{
+		{"translate", "2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z"},
+		{"query", "2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z"},
+		{"query", "2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z"},
+		{"query", "2024-01-02T00:00:10Z", "2024-01-02T00:30:10Z"},
+	} {
+		execMode := tc.execMode
+		reqBody := map[string]string{
+			"logql":    `{app="nginx", level="error"}`,
+			"execMode": execMode,
+			"start":    tc.start,
+			"end":      tc.end,
+		}
+		buf, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		te.check(t)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		var resp struct {
+			LogsQL string `json:"logsql"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid json response: %v", err)
+		}
+		if execMode == "translate" {
+			if lookups.Load() != 0 {
+				t.Fatalf("expected no stream fields lookup in the translate mode")
+			}
+			continue
+		}
+		if resp.LogsQL != `{app="nginx"} level:=error` {
+			t.Fatalf("unexpected LogsQL: %s", resp.LogsQL)
+		}
+	}
+	// Stream fields are cached per time range, which is extended to whole minutes.
+	expectedRanges := []string{"2024-01-01T00:00:00Z 2024-01-01T01:00:00Z", "2024-01-02T00:00:00Z 2024-01-02T00:31:00Z"}
+	if !slices.Equal(lookupRanges, expectedRanges) {
+		t.Fatalf("unexpected stream field names time ranges: %q", lookupRanges)
+	}
+	if n := queries.Load(); n != 3 {
+		t.Fatalf("expected 3 queries; got %d", n)
+	}
+}
+
+func TestHandleQueryRateMatchesLoki(t *testing.T) {
+	base := time.Unix(1700000000, 0)
+	offsets := []int{-290, -200, -61, -60, -30, 0, 30, 150, 299, 300}
+
+	// Expected values are calculated by Loki rules: count (or bytes) of logs in (t-range-offset, t-offset] divided by range seconds for rates.
+	// Instant queries are evaluated at end.
+	testCases := []struct {
+		logql        string
+		rangeSeconds int
+		instant      bool
+		start        int
+		end          int
+		step         string
+		expected     string
+	}{
+		{
+			logql:        `sum(rate({app="nginx"}[5m]))`,
+			rangeSeconds: 300,
+			start:        0,
+			end:          300,
+			step:         "5m",
+			expected:     `[[1700000000,"0.02"],[1700000300,"0.013333333333333334"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[5m]))`,
+			rangeSeconds: 300,
+			start:        60,
+			end:          120,
+			step:         "1m",
+			expected:     `[[1700000060,"0.02"],[1700000120,"0.016666666666666666"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[1m] offset 1m))`,
+			rangeSeconds: 60,
+			start:        0,
+			end:          120,
+			step:         "60",
+			expected:     `[[1700000000,"0.03333333333333333"],[1700000060,"0.03333333333333333"],[1700000120,"0.016666666666666666"]]`,
+		},
+		{
+			logql:        `sum(bytes_rate({app="nginx"}[5m]))`,
+			rangeSeconds: 300,
+			start:        0,
+			end:          300,
+			step:         "5m",
+			expected:     `[[1700000000,"0.07"],[1700000300,"0.11333333333333333"]]`,
+		},
+		{
+			logql:        `sum(bytes_rate({app="nginx"}[2m] offset 30s))`,
+			rangeSeconds: 120,
+			start:        -60,
+			end:          0,
+			step:         "1m",
+			expected:     `[[1699999940,"0.016666666666666666"],[1700000000,"0.1"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[5m]))`,
+			rangeSeconds: 300,
+			start:        0,
+			end:          300,
+			step:         "1m",
+			expected:     `[[1700000000,"0.02"],[1700000060,"0.02"],[1700000120,"0.016666666666666666"],[1700000180,"0.02"],[1700000240,"0.013333333333333334"],[1700000300,"0.013333333333333334"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[2m]))`,
+			rangeSeconds: 120,
+			start:        -240,
+			end:          300,
+			step:         "3m",
+			expected:     `[[1699999760,"0.008333333333333333"],[1699999940,"0.016666666666666666"],[1700000120,"0.008333333333333333"],[1700000300,"0.016666666666666666"]]`,
+		},
+		{
+			logql:    `sum(count_over_time({app="nginx"}[3m] offset 30s))`,
+			start:    -120,
+			end:      240,
+			step:     "2m",
+			expected: `[[1699999880,"2"],[1700000000,"4"],[1700000120,"5"],[1700000240,"1"]]`,
+		},
+		{
+			logql:        `sum(bytes_rate({app="nginx"}[2m] offset 30s))`,
+			rangeSeconds: 120,
+			start:        0,
+			end:          120,
+			step:         "1m",
+			expected:     `[[1700000000,"0.1"],[1700000060,"0.20833333333333334"],[1700000120,"0.10833333333333334"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[1m])) * 60`,
+			rangeSeconds: 60,
+			start:        -60,
+			end:          60,
+			step:         "1m",
+			expected:     `[[1699999940,"2"],[1700000000,"2"],[1700000060,"1"]]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[5m]))`,
+			rangeSeconds: 300,
+			instant:      true,
+			end:          300,
+			expected:     `[1700000300,"0.013333333333333334"]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[1m] offset 1m))`,
+			rangeSeconds: 60,
+			instant:      true,
+			end:          60,
+			expected:     `[1700000060,"0.03333333333333333"]`,
+		},
+		{
+			logql:        `sum(bytes_rate({app="nginx"}[2m] offset 30s))`,
+			rangeSeconds: 120,
+			instant:      true,
+			end:          120,
+			expected:     `[1700000120,"0.10833333333333334"]`,
+		},
+		{
+			logql:    `sum(count_over_time({app="nginx"}[3m] offset 30s))`,
+			instant:  true,
+			end:      0,
+			expected: `[1700000000,"4"]`,
+		},
+		{
+			logql:        `sum(rate({app="nginx"}[1m])) * 60`,
+			rangeSeconds: 60,
+			instant:      true,
+			end:          60,
+			expected:     `[1700000060,"1"]`,
+		},
+	}
+	for _, tc := range testCases {
+		srv, err := NewServer(Config{Endpoint: "http://victoria", Limit: 1000})
+		if err != nil {
+			t.Fatalf("NewServer error: %v", err)
+		}
+		var te transportErrors
+		srv.setHTTPClient(&http.Client{Transport: fakeRateVictoriaLogs(&te, base, offsets, tc.rangeSeconds)})
+
+		reqBody := map[string]string{
+			"logql": tc.logql,
+			"start": strconv.FormatInt(base.Unix()+int64(tc.start), 10),
+			"end":   strconv.FormatInt(base.Unix()+int64(tc.end), 10),
+			"step":  tc.step,
+		}
+		if tc.instant {
+			delete(reqBody, "start")
+		}
+		buf, _ := json.Marshal(reqBody)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/logql-to-logsql", bytes.NewReader(buf))
+		req.Header.Set("Content-Type", "application/json")
+
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		te.check(t)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tc.logql, rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			Data string `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid json response: %v", err)
+		}
+		expected := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"value"},"values":` + tc.expected + `}]}}`
+		if tc.instant {
+			expected = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"value"},"value":` + tc.expected + `}]}}`
+		}
+		if resp.Data != expected {
+			t.Fatalf("%s from %d to %d: unexpected data: %s", tc.logql, tc.start, tc.end, resp.Data)
+		}
+	}
+}
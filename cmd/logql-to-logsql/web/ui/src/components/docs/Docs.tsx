@@ -75,7 +75,10 @@ export function Docs() {
               <p>
                 <ul className={"list-disc pl-4 pt-2"}>
                   <li>
-                    <code>|=, !=, |~, !~</code>
+                    <code>|=, !=, |~, !~, |&gt;, !&gt;</code>
+                  </li>
+                  <li>
+                    <code>|= ip(), != ip()</code>
                   </li>
                   <li>
                     <code>| json, | logfmt, | regexp, | pattern</code>
@@ -101,16 +104,25 @@ export function Docs() {
               <p>
                 <ul className={"list-disc pl-4 pt-2"}>
                   <li>
-                    <code>rate, count_over_time</code>
+                    <code>rate, count_over_time, bytes_rate, bytes_over_time, absent_over_time</code>
+                  </li>
+                  <li>
+                    <code>sum, avg, min, max, count, stddev, stdvar</code>
+                  </li>
+                  <li>
+                    <code>topk, bottomk, sort, sort_desc</code>
+                  </li>
+                  <li>
+                    <code>avg_over_time, min_over_time, max_over_time, first_over_time, last_over_time</code>
                   </li>
                   <li>
-                    <code>sum, topk, bottomk</code>
+                    <code>quantile_over_time, stddev_over_time, stdvar_over_time, rate_counter</code>
                   </li>
                   <li>
-                    <code>avg_over_time, min_over_time, max_over_time</code>
+                    <code>+, -, *, /, %, ^</code>
                   </li>
                   <li>
-                    <code>quantile_over_time</code>
+                    <code>vector(), or, label_replace()</code>
                   </li>
                 </ul>
               </p>
@@ -86,4 +86,14 @@ export const EXAMPLES = [
     title: "topk(K, sum by (label) (rate(...)))",
     logql: `topk(5, sum by (severity) (rate({collector="otel-collector"}[5m])))`,
   },
+  {
+    id: "topk_by_group",
+    title: "topk by (label) (K, ...)",
+    logql: `topk by (service_name) (3, sum by (service_name, severity) (rate({collector="otel-collector"}[5m])))`,
+  },
+  {
+    id: "error_ratio",
+    title: "Error ratio (binary operation)",
+    logql: `sum(rate({collector="otel-collector"} |= "error" [5m])) / sum(rate({collector="otel-collector"}[5m]))`,
+  },
 ];
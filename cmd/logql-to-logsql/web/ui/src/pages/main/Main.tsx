@@ -95,6 +95,12 @@ export function Main() {
       setQuery(body.logsql);
       setResults(body.data);
       setLoading(false);
+      if (body.warnings?.length) {
+        toast.warning("translation warnings:", {
+          description: body.warnings.join("\n"),
+          duration: 10000,
+        });
+      }
       const durationMs = performance.now() - execStart;
       const executionTimeMessage = formatExecutionTime(durationMs);
       setSuccess(
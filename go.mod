@@ -6,6 +6,7 @@ require (
 	github.com/grafana/loki/v3 v3.6.3
 	github.com/prometheus/common v0.67.5
 	github.com/prometheus/prometheus v0.309.1
+	go4.org/netipx v0.0.0-20230125063823-8449b0a6169f
 )
 
 require (
@@ -139,7 +140,6 @@ require (
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.1 // indirect
 	go.yaml.in/yaml/v2 v2.4.3 // indirect
-	go4.org/netipx v0.0.0-20230125063823-8449b0a6169f // indirect
 	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/exp v0.0.0-20250808145144-a408d31f581a // indirect
 	golang.org/x/mod v0.30.0 // indirect
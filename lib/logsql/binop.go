@@ -0,0 +1,459 @@
+package logsql
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/promql"
+)
+
+const (
+	// binOpJoinKey is a constant field used for joining series without labels.
+	binOpJoinKey = "_binop_key"
+	// binOpRightMarker marks rows of the right operand, so they sort after rows of the left operand.
+	binOpRightMarker = "_binop_rhs"
+	// binOpMatches holds the number of series of the other operand matching the series.
+	binOpMatches = "_binop_matches"
+	// binOpDiffField holds the difference of the operands compared by comparison operators.
+	binOpDiffField = "_binop_diff"
+	// binOpStreamField holds the `_stream` label without the labels ignored by the vector matching.
+	binOpStreamField = "_binop_stream"
+	// binOpLeftSamples and binOpRightSamples hold the number of logs matching the operands of merged stats.
+	binOpLeftSamples  = "_binop_lhs_samples"
+	binOpRightSamples = "_binop_rhs_samples"
+)
+
+// comparisonFilters contains LogsQL filters on binOpDiffField for LogQL comparison operators.
+var comparisonFilters = map[string]string{
+	syntax.OpTypeCmpEQ: binOpDiffField + ":range[0, 0]",
+	syntax.OpTypeNEQ:   "NOT " + binOpDiffField + ":range[0, 0]",
+	syntax.OpTypeGT:    binOpDiffField + ":>0",
+	syntax.OpTypeGTE:   binOpDiffField + ":>=0",
+	syntax.OpTypeLT:    binOpDiffField + ":<0",
+	syntax.OpTypeLTE:   binOpDiffField + ":<=0",
+}
+
+func (tr *Translator) translateBinOpExpr(e *syntax.BinOpExpr) (*statsQuery, error) {
+	left, err := tr.translateSampleExpr(e.SampleExpr)
+	if err != nil {
+		return nil, err
+	}
+	right, err := tr.translateSampleExpr(e.RHS)
+	if err != nil {
+		return nil, err
+	}
+
+	var vm *syntax.VectorMatching
+	if e.Opts != nil && e.Opts.VectorMatching != nil {
+		m := *e.Opts.VectorMatching
+		m.MatchingLabels = tr.labels.fieldNames(m.MatchingLabels)
+		m.Include = tr.labels.fieldNames(m.Include)
+		vm = &m
+	}
+	if isSetBinOp(e.Op) && tr.evalRange != nil && (left.constant == nil) != (right.constant == nil) {
+		// The constant operand must have a series at every point, so it replaces the missing series of every point.
+		for _, q := range []*statsQuery{left, right} {
+			if q.constant != nil {
+				tr.evalRange.constantSeries(q)
+			}
+		}
+	}
+	warnings := append(slices.Clone(left.warnings), right.warnings...)
+	q, err := combineBinOpStats(e, left, right, vm)
+	if err != nil {
+		return nil, err
+	}
+	q.warnings = warnings
+	return q, nil
+}
+
+func combineBinOpStats(e *syntax.BinOpExpr, left, right *statsQuery, vm *syntax.VectorMatching) (*statsQuery, error) {
+	switch e.Op {
+	case syntax.OpTypeOr:
+		return orBinOpStats(left, right, vm)
+	case syntax.OpTypeAnd:
+		return matchBinOpStats(left, right, vm, true)
+	case syntax.OpTypeUnless:
+		return matchBinOpStats(left, right, vm, false)
+	}
+	returnBool := e.Opts != nil && e.Opts.ReturnBool
+
+	if left.constant != nil && right.constant != nil {
+		v, err := mergeConstants(e.Op, *left.constant, *right.constant)
+		if err != nil {
+			return nil, err
+		}
+		return newConstStatsQuery(v), nil
+	}
+
+	// Scalars match every series, while vector() matches only series without labels.
+	_, leftScalar := e.SampleExpr.(*syntax.LiteralExpr)
+	_, rightScalar := e.RHS.(*syntax.LiteralExpr)
+	// Comparisons with scalars keep the series value, while comparisons with vector() keep the left value.
+	if right.constant != nil && (rightScalar || matchesSeriesWithoutLabels(left.labels, vm)) {
+		pipes, temps := binOpValuePipes("value", e.Op, formatMathNumber(*right.constant), "value", returnBool)
+		left.pipes = append(left.pipes, pipes...)
+		left.pipes = appendDeletePipe(left.pipes, temps)
+		return left, nil
+	}
+	if left.constant != nil && (leftScalar || matchesSeriesWithoutLabels(right.labels, vm)) {
+		keep := "value"
+		if !leftScalar {
+			keep = formatMathNumber(*left.constant)
+		}
+		pipes, temps := binOpValuePipes(formatMathNumber(*left.constant), e.Op, "value", keep, returnBool)
+		right.pipes = append(right.pipes, pipes...)
+		right.pipes = appendDeletePipe(right.pipes, temps)
+		return right, nil
+	}
+	if left.constant != nil || right.constant != nil {
+		return nil, &TranslationError{
+			Code:    http.StatusBadRequest,
+			Message: "LogQL vector() has no labels, so it doesn't match series with labels; use on() with group_left or group_right",
+		}
+	}
+
+	if canMergeBinOp(left, right, vm) {
+		return mergeBinOpStats(left, right, e.Op, returnBool), nil
+	}
+	return joinBinOpStats(left, right, e.Op, returnBool, vm)
+}
+
+// binOpValuePipes returns pipes calculating the `value` field of the binary operation op over the lhs and rhs expressions
+// and the temporary fields they create. Comparison operators without bool keep the value of the keep expression.
+func binOpValuePipes(lhs, op, rhs, keep string, returnBool bool) ([]string, []string) {
+	filter, ok := comparisonFilters[op]
+	if !ok {
+		return []string{mathPipe(lhs, op, rhs)}, nil
+	}
+	pipes := []string{fmt.Sprintf("math (%s - %s) as %s", lhs, rhs, binOpDiffField)}
+	switch {
+	case returnBool:
+		pipes = append(pipes, `format "0" as value`, "format if ("+filter+`) "1" as value`)
+	case keep == "value":
+		pipes = append(pipes, "filter "+filter)
+	default:
+		pipes = append(pipes, "filter "+filter, "math "+keep+" as value")
+	}
+	return pipes, []string{binOpDiffField}
+}
+
+func appendDeletePipe(pipes, fields []string) []string {
+	if len(fields) == 0 {
+		return pipes
+	}
+	return append(pipes, "delete "+strings.Join(fields, ", "))
+}
+
+// matchesSeriesWithoutLabels returns true if series with the given labels match a series without labels.
+func matchesSeriesWithoutLabels(labels []string, vm *syntax.VectorMatching) bool {
+	if len(removeLabels(labels, []string{RangePointField})) == 0 {
+		return true
+	}
+	return vm != nil && vm.On && len(vm.MatchingLabels) == 0 && vm.Card != syntax.CardOneToOne
+}
+
+func mergeConstants(op string, left, right float64) (float64, error) {
+	s, err := syntax.MergeBinOp(op, &promql.Sample{F: left}, &promql.Sample{F: right}, false, false, false)
+	if err != nil {
+		return 0, newBadRequest("cannot evaluate LogQL binary operation", err)
+	}
+	return s.F, nil
+}
+
+// orBinOpStats returns all the series from the left query plus the series from the right query,
+// which have no matching label set in the left query.
+func orBinOpStats(left, right *statsQuery, vm *syntax.VectorMatching) (*statsQuery, error) {
+	if left.constant != nil && right.constant != nil {
+		return left, nil
+	}
+	if vm != nil && (vm.On || len(vm.MatchingLabels) > 0) {
+		return orMatchingBinOpStats(left, right, vm)
+	}
+	labels := appendMissing(slices.Clone(left.labels), right.labels)
+
+	sub := *right
+	sub.pipes = append(slices.Clone(right.pipes), "format \"1\" as "+binOpRightMarker)
+
+	first := "first 1 (" + binOpRightMarker + ")"
+	if len(labels) > 0 {
+		first += " partition by (" + strings.Join(labels, ", ") + ")"
+	}
+
+	q := *left
+	q.pipes = append(slices.Clone(left.pipes),
+		"union ("+sub.String()+")",
+		first,
+		"delete "+binOpRightMarker,
+	)
+	q.base = ""
+	q.cond = ""
+	q.labels = labels
+	q.constant = nil
+	return &q, nil
+}
+
+// orMatchingBinOpStats returns all the series from the left query plus the series from the right query,
+// which have no left series with the same values of the labels matched by on(...) or ignoring(...).
+func orMatchingBinOpStats(left, right *statsQuery, vm *syntax.VectorMatching) (*statsQuery, error) {
+	sub, err := matchBinOpStats(right, left, vm, false)
+	if err != nil {
+		return nil, err
+	}
+	q := *left
+	q.pipes = append(slices.Clone(left.pipes), "union ("+sub.String()+")")
+	q.base = ""
+	q.cond = ""
+	q.labels = appendMissing(slices.Clone(left.labels), right.labels)
+	q.constant = nil
+	return &q, nil
+}
+
+// matchBinOpStats returns the series of q, which have (if matched is set) or don't have series in other
+// with the same values of the matched labels: all the labels unless on(...) or ignoring(...) is set.
+func matchBinOpStats(q, other *statsQuery, vm *syntax.VectorMatching, matched bool) (*statsQuery, error) {
+	labels := appendMissing(slices.Clone(q.labels), other.labels)
+	if vm == nil {
+		vm = &syntax.VectorMatching{}
+	}
+	g := &seriesGrouping{by: pointGrouping(vm.MatchingLabels, labels)}
+	if !vm.On {
+		var err error
+		g, err = translateGrouping(&syntax.Grouping{Groups: vm.MatchingLabels, Without: true}, labels, binOpStreamField)
+		if err != nil {
+			return nil, err
+		}
+	}
+	by := g.by
+	keyPipes := slices.Clone(g.pipes)
+	temps := []string{binOpMatches}
+	if slices.Contains(by, binOpStreamField) {
+		temps = append(temps, binOpStreamField)
+	}
+	if len(by) == 0 {
+		by = []string{binOpJoinKey}
+		keyPipes = append(keyPipes, "format \"1\" as "+binOpJoinKey)
+		temps = append(temps, binOpJoinKey)
+	}
+
+	matches := *other
+	matches.pipes = append(slices.Clone(other.pipes), keyPipes...)
+	matches.pipes = append(matches.pipes, statsPipe(by, "count() as "+binOpMatches))
+
+	filter := binOpMatches + ":\"\""
+	if matched {
+		filter = binOpMatches + ":>0"
+	}
+	res := *q
+	res.pipes = append(slices.Clone(q.pipes), keyPipes...)
+	res.pipes = append(res.pipes,
+		fmt.Sprintf("join by (%s) (%s)", strings.Join(by, ", "), matches.String()),
+		"filter "+filter,
+		"delete "+strings.Join(temps, ", "),
+	)
+	res.base = ""
+	res.cond = ""
+	res.constant = nil
+	return &res, nil
+}
+
+// isSetBinOp returns true if op is one of LogQL or, and and unless operators.
+func isSetBinOp(op string) bool {
+	switch op {
+	case syntax.OpTypeOr, syntax.OpTypeAnd, syntax.OpTypeUnless:
+		return true
+	default:
+		return false
+	}
+}
+
+// canMergeBinOp returns true if both operands can be calculated by a single stats pipe.
+func canMergeBinOp(left, right *statsQuery, vm *syntax.VectorMatching) bool {
+	if !left.canMergeStats() || !right.canMergeStats() {
+		return false
+	}
+	if vm != nil && (vm.On || len(vm.MatchingLabels) > 0 || vm.Card != syntax.CardOneToOne) {
+		return false
+	}
+	return left.base == right.base && slices.Equal(left.by, right.by)
+}
+
+// mergeBinOpStats calculates both operands in a single stats pipe over the shared base
+// and combines them with the math pipe.
+func mergeBinOpStats(left, right *statsQuery, op string, returnBool bool) *statsQuery {
+	funcs := statsFuncWithCond(left.fn, left.cond) + " as lhs, " + statsFuncWithCond(right.fn, right.cond) + " as rhs"
+	// Loki has no series for the group if one of the operands has no samples in it, so such groups are dropped.
+	var filters, temps []string
+	for _, s := range []struct {
+		q             *statsQuery
+		value, sample string
+	}{{left, "lhs", binOpLeftSamples}, {right, "rhs", binOpRightSamples}} {
+		switch {
+		case s.q.fn == "count()":
+			filters = append(filters, s.value+":>0")
+		case s.q.cond != "" || len(s.q.by) == 0:
+			funcs += ", " + statsFuncWithCond("count()", s.q.cond) + " as " + s.sample
+			filters = append(filters, s.sample+":>0")
+			temps = append(temps, s.sample)
+		}
+	}
+	pipes := []string{statsPipe(left.by, funcs)}
+	if len(filters) > 0 {
+		pipes = append(pipes, "filter "+strings.Join(filters, " "))
+	}
+	lhs, rhs := "lhs", "rhs"
+	if left.divisor != "" {
+		lhs = "(lhs / " + left.divisor + ")"
+	}
+	if right.divisor != "" {
+		rhs = "(rhs / " + right.divisor + ")"
+	}
+	valuePipes, valueTemps := binOpValuePipes(lhs, op, rhs, lhs, returnBool)
+	pipes = append(pipes, valuePipes...)
+	pipes = appendDeletePipe(pipes, append(append([]string{"lhs", "rhs"}, temps...), valueTemps...))
+	return &statsQuery{
+		source: left.base,
+		by:     left.by,
+		pipes:  pipes,
+		labels: left.labels,
+	}
+}
+
+// joinBinOpStats combines operands calculated by separate queries with the join pipe.
+func joinBinOpStats(left, right *statsQuery, op string, returnBool bool, vm *syntax.VectorMatching) (*statsQuery, error) {
+	match, err := binOpMatchingLabels(left.labels, right.labels, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	main, sub := left, right
+	mainName, subName := "lhs", "rhs"
+	var include []string
+	resultLabels := match
+	if vm != nil {
+		switch vm.Card {
+		case syntax.CardManyToOne:
+			include = vm.Include
+			resultLabels = appendMissing(slices.Clone(left.labels), vm.Include)
+		case syntax.CardOneToMany:
+			main, sub = right, left
+			mainName, subName = "rhs", "lhs"
+			include = vm.Include
+			resultLabels = appendMissing(slices.Clone(right.labels), vm.Include)
+		default:
+			if !vm.On && len(vm.MatchingLabels) == 0 {
+				resultLabels = left.labels
+			}
+		}
+	}
+
+	joinBy := match
+	mainPipes := []string{"rename value as " + mainName}
+	subPipes := []string{"rename value as " + subName}
+	if len(match) == 0 {
+		joinBy = []string{binOpJoinKey}
+		mainPipes = append(mainPipes, "format \"1\" as "+binOpJoinKey)
+		subPipes = append(subPipes, "format \"1\" as "+binOpJoinKey)
+	}
+	subFields := appendMissing(slices.Clone(joinBy), include)
+	subFields = append(subFields, subName)
+	subPipes = append(subPipes, "fields "+strings.Join(subFields, ", "))
+
+	subQuery := *sub
+	subQuery.pipes = append(slices.Clone(sub.pipes), subPipes...)
+
+	q := *main
+	q.pipes = append(slices.Clone(main.pipes), mainPipes...)
+	q.pipes = append(q.pipes,
+		fmt.Sprintf("join by (%s) (%s) inner", strings.Join(joinBy, ", "), subQuery.String()),
+	)
+	valuePipes, _ := binOpValuePipes("lhs", op, "rhs", "lhs", returnBool)
+	q.pipes = append(q.pipes, valuePipes...)
+	q.pipes = append(q.pipes, "fields "+strings.Join(append(slices.Clone(resultLabels), "value"), ", "))
+	q.base = ""
+	q.cond = ""
+	q.labels = resultLabels
+	return &q, nil
+}
+
+// binOpMatchingLabels returns labels used for matching series of both operands according to LogQL vector matching rules.
+func binOpMatchingLabels(left, right []string, vm *syntax.VectorMatching) ([]string, error) {
+	if vm != nil && vm.On {
+		return pointGrouping(vm.MatchingLabels, left), nil
+	}
+	var ignoring []string
+	if vm != nil {
+		ignoring = vm.MatchingLabels
+	}
+	l := removeLabels(left, ignoring)
+	r := removeLabels(right, ignoring)
+	if !sameLabelSet(l, r) {
+		return nil, &TranslationError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("LogQL binary operation sides have different labels (%s) and (%s); use on(...) or ignoring(...) to match them", strings.Join(left, ", "), strings.Join(right, ", ")),
+		}
+	}
+	return l, nil
+}
+
+func statsFuncWithCond(fn, cond string) string {
+	if cond == "" {
+		return fn
+	}
+	return fn + " if (" + cond + ")"
+}
+
+func mathPipe(left, op, right string) string {
+	return fmt.Sprintf("math (%s %s %s) as value", left, op, right)
+}
+
+func formatMathNumber(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "(0 / 0)"
+	case math.IsInf(v, 1):
+		return "(1 / 0)"
+	case math.IsInf(v, -1):
+		return "(-1 / 0)"
+	}
+	s := formatFloat(v)
+	if v < 0 {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+func removeLabels(src, remove []string) []string {
+	out := make([]string, 0, len(src))
+	for _, l := range src {
+		if !slices.Contains(remove, l) {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func appendMissing(dst, src []string) []string {
+	for _, l := range src {
+		if !slices.Contains(dst, l) {
+			dst = append(dst, l)
+		}
+	}
+	return dst
+}
+
+func sameLabelSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, l := range a {
+		if !slices.Contains(b, l) {
+			return false
+		}
+	}
+	return true
+}
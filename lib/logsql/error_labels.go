@@ -0,0 +1,132 @@
+package logsql
+
+import (
+	"fmt"
+	"slices"
+
+	lokilog "github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Loki sets the `__error__` label when a pipeline stage fails and the `__error_details__` label with the failure reason.
+// VictoriaLogs doesn't report such failures, so the translation sets the `__error__` field for the failures,
+// which can be detected with LogsQL filters. The field is set only if the query refers to one of these labels.
+
+const (
+	errorLabel        = "__error__"
+	errorDetailsLabel = "__error_details__"
+
+	errJSONParser       = "JSONParserErr"
+	errLogfmtParser     = "LogfmtParserErr"
+	errSampleExtraction = "SampleExtractionErr"
+)
+
+// jsonObjectRegexp matches lines looking like JSON objects. Loki json and unpack parsers fail on other lines.
+const jsonObjectRegexp = `(?s)^\s*\{.*\}\s*$`
+
+// logfmtLineRegexp matches lines, which can be parsed by Loki logfmt parser without errors:
+// space-separated keys with optional unquoted or quoted values.
+const logfmtLineRegexp = `^\s*(?:[^\s="]+(?:=(?:"(?:[^"\\]|\\.)*"|[^\s="]*))?(?:\s+|$))*$`
+
+// unwrapValueRegexps contains regexps matching the values accepted by LogQL unwrap conversions.
+var unwrapValueRegexps = map[string]string{
+	// strconv.ParseFloat
+	"": `^[-+]?(?:(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?|(?i:inf|infinity|nan))$`,
+	// time.ParseDuration
+	syntax.OpConvDuration:        `^[-+]?(?:0|(?:(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:ns|us|µs|μs|ms|s|m|h))+)$`,
+	syntax.OpConvDurationSeconds: `^[-+]?(?:0|(?:(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:ns|us|µs|μs|ms|s|m|h))+)$`,
+	// humanize.ParseBytes
+	syntax.OpConvBytes: `(?i)^\s*[0-9.,]+\s*(?:[kmgtpe]i?b?|b)?\s*$`,
+}
+
+// refersToErrors returns true if the query refers to the `__error__` or `__error_details__` labels.
+func (tr *Translator) refersToErrors() bool {
+	return tr.refersToField(errorLabel) || tr.refersToField(errorDetailsLabel)
+}
+
+// jsonParserErrorPipe returns the pipe setting the `__error__` field for lines, which cannot be parsed by LogQL json parser.
+func (tr *Translator) jsonParserErrorPipe() string {
+	if !tr.refersToErrors() {
+		return ""
+	}
+	return errorPipe("NOT ~"+quoteString(jsonObjectRegexp), errJSONParser)
+}
+
+// logfmtParserErrorPipe returns the pipe setting the `__error__` field for lines, which cannot be parsed by LogQL logfmt parser
+// in the strict mode.
+func (tr *Translator) logfmtParserErrorPipe() string {
+	if !tr.refersToErrors() {
+		return ""
+	}
+	return errorPipe("NOT ~"+quoteString(logfmtLineRegexp), errLogfmtParser)
+}
+
+// parserErrorWarning is returned if the `__error__` field is set for json or logfmt parser failures.
+const parserErrorWarning = "json and logfmt parser errors in __error__ label are detected approximately by matching the log line with a regexp"
+
+// addParserErrorWarning adds parserErrorWarning if the `__error__` field is set for parser failures.
+func (b *logsQLBuilder) addParserErrorWarning() {
+	if b.tr.refersToErrors() && !slices.Contains(b.warnings, parserErrorWarning) {
+		b.addWarning(parserErrorWarning)
+	}
+}
+
+// strictParserWarning is returned for logfmt --strict, which is translated approximately.
+const strictParserWarning = "logfmt --strict is approximated: Loki stops parsing malformed lines at the first malformed pair, while all the pairs are unpacked here; " +
+	"malformed lines are detected by a regexp only if the query refers to __error__ label, and some of them may still pass __error__=\"\" filters"
+
+// addStrictParserWarning adds the warning about logfmt --strict and the warning about the detection of parser errors.
+func (b *logsQLBuilder) addStrictParserWarning() {
+	if !slices.Contains(b.warnings, strictParserWarning) {
+		b.addWarning(strictParserWarning)
+	}
+	b.addParserErrorWarning()
+}
+
+// unwrapErrorPipe returns the pipe setting the `__error__` field for logs, which unwrapped value cannot be converted to a number.
+func (tr *Translator) unwrapErrorPipe(u *syntax.UnwrapExpr) string {
+	if u == nil || !tr.refersToErrors() {
+		return ""
+	}
+	re, ok := unwrapValueRegexps[u.Operation]
+	if !ok {
+		return ""
+	}
+	field := quoteFieldNameIfNeeded(tr.labels.fieldName(u.Identifier))
+	return errorPipe("NOT "+field+":~"+quoteString(re), errSampleExtraction)
+}
+
+// errorPipe returns the pipe setting the `__error__` field to errType for logs matching the filter.
+func errorPipe(filter, errType string) string {
+	return fmt.Sprintf(`format if (%s:"" AND %s) %s as %s`, errorLabel, filter, quoteString(errType), errorLabel)
+}
+
+// errorDetailsWarning is returned if the query filters by `__error_details__` label.
+const errorDetailsWarning = "__error_details__ label isn't available in LogsQL; filters on it are applied to __error__ label"
+
+// translateErrorDetailsMatcher returns the LogsQL filter for the matcher on `__error_details__` label.
+func translateErrorDetailsMatcher(m *labels.Matcher) string {
+	switch {
+	case !m.Matches(""):
+		return errorLabel + ":*"
+	case m.Type == labels.MatchNotEqual || m.Type == labels.MatchNotRegexp:
+		return ""
+	default:
+		return errorLabel + `:=""`
+	}
+}
+
+// hasErrorDetailsFilter returns true if f filters by `__error_details__` label.
+func hasErrorDetailsFilter(f lokilog.LabelFilterer) bool {
+	switch t := f.(type) {
+	case *lokilog.BinaryLabelFilter:
+		return hasErrorDetailsFilter(t.Left) || hasErrorDetailsFilter(t.Right)
+	case *lokilog.StringLabelFilter:
+		return t.Matcher != nil && t.Matcher.Name == errorDetailsLabel
+	case *lokilog.LineFilterLabelFilter:
+		return t.Matcher != nil && t.Matcher.Name == errorDetailsLabel
+	default:
+		return false
+	}
+}
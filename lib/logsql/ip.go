@@ -0,0 +1,138 @@
+package logsql
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"go4.org/netipx"
+)
+
+// ipv4TokenBoundary matches the start or the end of an IPv4 token in the log line.
+const ipv4TokenBoundary = `[^0-9.]`
+
+// ipLineFilterRegexp returns the regexp matching lines containing IPv4 addresses
+// from the LogQL ip() line filter pattern: single IP, CIDR or IP range such as 192.168.0.1-192.168.0.23.
+func ipLineFilterRegexp(pattern string) (string, error) {
+	r, err := parseIPRange(pattern)
+	if err != nil {
+		return "", err
+	}
+	if !r.From().Is4() {
+		return "", &TranslationError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("only IPv4 addresses are supported in LogQL ip() line filter; got %q", pattern),
+		}
+	}
+
+	prefixes := r.Prefixes()
+	alts := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		alts = append(alts, ipv4PrefixRegexp(p))
+	}
+	ips := strings.Join(alts, "|")
+	if len(alts) > 1 {
+		ips = "(?:" + ips + ")"
+	}
+	return "(?:^|" + ipv4TokenBoundary + ")" + ips + "(?:$|" + ipv4TokenBoundary + ")", nil
+}
+
+// parseIPRange parses the pattern of LogQL ip() filter the same way as Loki does.
+func parseIPRange(pattern string) (netipx.IPRange, error) {
+	if ip, err := netip.ParseAddr(pattern); err == nil {
+		return netipx.IPRangeFrom(ip, ip), nil
+	}
+	if p, err := netip.ParsePrefix(pattern); err == nil {
+		return netipx.RangeOfPrefix(p.Masked()), nil
+	}
+	r, err := netipx.ParseIPRange(pattern)
+	if err != nil {
+		return netipx.IPRange{}, newBadRequest(fmt.Sprintf("invalid LogQL ip() filter pattern %q", pattern), err)
+	}
+	return r, nil
+}
+
+// ipv4PrefixRegexp returns the regexp matching IPv4 addresses from p in the dotted decimal form.
+func ipv4PrefixRegexp(p netip.Prefix) string {
+	ip := p.Addr().As4()
+	octets := make([]string, 0, len(ip))
+	for i, v := range ip {
+		bits := min(max(p.Bits()-8*i, 0), 8)
+		lo := int(v)
+		hi := lo | (1<<(8-bits) - 1)
+		octets = append(octets, numberRangeRegexp(lo, hi))
+	}
+	return strings.Join(octets, `\.`)
+}
+
+// numberRangeRegexp returns the regexp matching decimal numbers without leading zeros in the range [lo, hi].
+func numberRangeRegexp(lo, hi int) string {
+	var alts []string
+	// Numbers of different lengths are matched by separate alternatives.
+	for start, end := 0, 9; start <= hi; start, end = end+1, end*10+9 {
+		from, to := max(lo, start), min(hi, end)
+		if from > to {
+			continue
+		}
+		alts = append(alts, sameWidthRangeRegexp(strconv.Itoa(from), strconv.Itoa(to))...)
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return "(?:" + strings.Join(alts, "|") + ")"
+}
+
+// sameWidthRangeRegexp returns regexp alternatives matching numbers of the same width in the range [lo, hi].
+func sameWidthRangeRegexp(lo, hi string) []string {
+	if lo == hi {
+		return []string{lo}
+	}
+	if lo[0] == hi[0] {
+		rest := sameWidthRangeRegexp(lo[1:], hi[1:])
+		if len(rest) == 1 {
+			return []string{lo[:1] + rest[0]}
+		}
+		return []string{lo[:1] + "(?:" + strings.Join(rest, "|") + ")"}
+	}
+	n := len(lo) - 1
+	if strings.Trim(lo[1:], "0") == "" && strings.Trim(hi[1:], "9") == "" {
+		return []string{digitRangeRegexp(lo[0], hi[0]) + anyDigitsRegexp(n)}
+	}
+	var alts []string
+	loFirst, hiFirst := lo[0], hi[0]
+	if strings.Trim(lo[1:], "0") != "" {
+		alts = append(alts, sameWidthRangeRegexp(lo, lo[:1]+strings.Repeat("9", n))...)
+		loFirst++
+	}
+	hiRest := hi[1:]
+	if strings.Trim(hiRest, "9") != "" {
+		hiFirst--
+	}
+	if loFirst <= hiFirst {
+		alts = append(alts, digitRangeRegexp(loFirst, hiFirst)+anyDigitsRegexp(n))
+	}
+	if strings.Trim(hiRest, "9") != "" {
+		alts = append(alts, sameWidthRangeRegexp(hi[:1]+strings.Repeat("0", n), hi)...)
+	}
+	return alts
+}
+
+func digitRangeRegexp(lo, hi byte) string {
+	if lo == hi {
+		return string(lo)
+	}
+	return "[" + string(lo) + "-" + string(hi) + "]"
+}
+
+func anyDigitsRegexp(n int) string {
+	switch n {
+	case 0:
+		return ""
+	case 1:
+		return "[0-9]"
+	default:
+		return "[0-9]{" + strconv.Itoa(n) + "}"
+	}
+}
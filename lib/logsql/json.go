@@ -0,0 +1,183 @@
+package logsql
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
+
+// LogQL json and unpack parsers name labels differently than LogsQL unpack_json names fields:
+
+const (
+	// jsonDuplicateSuffix is the suffix Loki adds to the extracted labels clashing with the existing labels.
+	jsonDuplicateSuffix = "_extracted"
+
+	// jsonDuplicatePrefix is the prefix of temporary fields holding the values of clashing JSON keys.
+	jsonDuplicatePrefix = "_json_extracted."
+
+	// jsonPackedEntryField is the JSON key holding the original log line packed by Promtail pack stage.
+	jsonPackedEntryField = "_entry"
+
+	// maxJSONLabelSeparators limits the number of `_` separators in a label name, for which all the possible
+	// source field names are checked. Only the name with all separators replaced by `.` is checked for longer names.
+	maxJSONLabelSeparators = 4
+)
+
+// jsonParserPipes returns LogsQL pipes for LogQL json and unpack parsers without expressions.
+func (tr *Translator) jsonParserPipes(op string) []string {
+	unpack := op == syntax.OpParserTypeUnpack
+
+	var pipes []string
+	if pipe := tr.jsonParserErrorPipe(); pipe != "" {
+		pipes = append(pipes, pipe)
+	}
+	if unpack {
+		// Loki unpack extracts labels only from entries packed by Promtail and replaces the line with the packed one.
+		pipes = append(pipes, "unpack_json fields ("+jsonPackedEntryField+")")
+	}
+	// Clashing keys must be extracted before the main unpacking, since it adds new fields.
+	var temps []string
+	for _, ref := range tr.labelRefs {
+		base, ok := strings.CutSuffix(ref.label, jsonDuplicateSuffix)
+		if !ok || base == "" {
+			continue
+		}
+		srcs := parsedLabelSources(base, true)
+		if len(srcs) == 0 {
+			continue
+		}
+		placeholders := make([]string, 0, len(srcs))
+		for _, src := range srcs {
+			temp := jsonDuplicatePrefix + src
+			placeholders = append(placeholders, "<"+temp+">")
+			temps = append(temps, quoteFieldNameIfNeeded(temp))
+		}
+		p := "unpack_json"
+		if unpack {
+			p += " if (" + jsonPackedEntryField + ":*)"
+		}
+		pipes = append(pipes,
+			p+" fields ("+strings.Join(srcs, ", ")+") result_prefix "+quoteString(jsonDuplicatePrefix),
+			"format if ("+quoteFieldNameIfNeeded(tr.labels.fieldName(base))+":*) "+quoteString(strings.Join(placeholders, ""))+" as "+quoteFieldNameIfNeeded(ref.field))
+	}
+	if len(temps) > 0 {
+		pipes = append(pipes, "delete "+strings.Join(temps, ", "))
+	}
+
+	// Existing fields are kept the same way as Loki keeps the existing labels.
+	if unpack {
+		pipes = append(pipes, "unpack_json if ("+jsonPackedEntryField+":*) keep_original_fields")
+	} else {
+		pipes = append(pipes, "unpack_json keep_original_fields")
+	}
+	for _, ref := range tr.labelRefs {
+		if strings.HasSuffix(ref.label, jsonDuplicateSuffix) {
+			continue
+		}
+		if srcs := parsedLabelSources(ref.label, ref.field != ref.label); len(srcs) > 0 {
+			pipes = append(pipes, parsedLabelPipe(ref.field, srcs))
+		}
+	}
+	if unpack {
+		pipes = append(pipes,
+			"format if ("+jsonPackedEntryField+":*) "+quoteString("<"+jsonPackedEntryField+">")+" as _msg",
+			"delete "+jsonPackedEntryField)
+	}
+	return pipes
+}
+
+// logfmtLabelPipes returns pipes setting the fields of the referenced labels to the values of the logfmt keys,
+// which Loki logfmt parser names as the labels. Values of log stream fields are kept.
+func (tr *Translator) logfmtLabelPipes() []string {
+	var pipes []string
+	for _, ref := range tr.labelRefs {
+		if srcs := parsedLabelSources(ref.label, ref.field != ref.label); len(srcs) > 0 {
+			pipes = append(pipes, parsedLabelPipe(ref.field, srcs))
+		}
+	}
+	return pipes
+}
+
+// sanitizedKeysWarning is returned if labels extracted by json or logfmt parsers may come from keys with other chars than `.` and `-`.
+const sanitizedKeysWarning = "Loki replaces chars other than letters, digits and _ in json and logfmt keys with _; labels with _ are restored only from keys with . or - in place of _"
+
+// addSanitizedKeysWarning adds sanitizedKeysWarning if the query refers to labels with `_` extracted by json or logfmt parsers.
+func (b *logsQLBuilder) addSanitizedKeysWarning() {
+	for _, ref := range b.tr.labelRefs {
+		if strings.Contains(ref.label, "_") && len(parsedLabelSources(ref.label, false)) > 0 {
+			if !slices.Contains(b.warnings, sanitizedKeysWarning) {
+				b.addWarning(sanitizedKeysWarning)
+			}
+			return
+		}
+	}
+}
+
+// parsedLabelPipe returns the pipe setting the empty field to the concatenated values of the parsed srcs fields.
+func parsedLabelPipe(field string, srcs []string) string {
+	placeholders := make([]string, 0, len(srcs))
+	for _, src := range srcs {
+		placeholders = append(placeholders, "<"+src+">")
+	}
+	name := quoteFieldNameIfNeeded(field)
+	return "format if (" + name + `:"") ` + quoteString(strings.Join(placeholders, "")) + " as " + name
+}
+
+// parsedLabelSources returns LogsQL unpack_json and unpack_logfmt field names, which Loki json and logfmt parsers name as label.
+func parsedLabelSources(label string, self bool) []string {
+	if strings.HasPrefix(label, "__") || slices.Contains(keepBuiltinFields, label) {
+		return nil
+	}
+	parts := strings.Split(label, "_")
+	seps := len(parts) - 1
+	if seps == 0 {
+		if self {
+			return []string{label}
+		}
+		return nil
+	}
+	var srcs []string
+	if seps > maxJSONLabelSeparators {
+		if src := joinJSONLabelParts(parts, 1<<seps-1); src != "" {
+			srcs = append(srcs, src)
+		}
+	} else {
+		// Bit i of the mask is set if the i-th separator is `.`. Nested keys are tried first.
+		for mask := 1<<seps - 1; mask > 0; mask-- {
+			if src := joinJSONLabelParts(parts, mask); src != "" {
+				srcs = append(srcs, src)
+			}
+		}
+	}
+	// Loki replaces `-` in keys with `_` and prefixes keys starting with a digit with `_`.
+	if !slices.Contains(parts, "") {
+		srcs = append(srcs, strings.Join(parts, "-"))
+	}
+	if len(label) > 1 && label[0] == '_' && label[1] >= '0' && label[1] <= '9' {
+		srcs = append(srcs, label[1:])
+	}
+	if self {
+		srcs = append(srcs, label)
+	}
+	return srcs
+}
+
+// joinJSONLabelParts joins label parts with `.` at separators set in the mask and with `_` at the rest.
+func joinJSONLabelParts(parts []string, mask int) string {
+	var sb strings.Builder
+	sb.WriteString(parts[0])
+	for i, part := range parts[1:] {
+		if mask&(1<<i) == 0 {
+			sb.WriteByte('_')
+		} else {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(part)
+	}
+	name := sb.String()
+	if slices.Contains(strings.Split(name, "."), "") {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,289 @@
+package logsql
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	lokilog "github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LabelMapping maps LogQL label names to VictoriaLogs field names.
+type LabelMapping struct {
+	// Preset is the name of the predefined mapping for a log shipper. See LabelMappingPresets.
+	Preset string `json:"preset,omitempty"`
+	// Exact maps label names to field names.
+	Exact map[string]string `json:"exact,omitempty"`
+	// Regex contains rules for mapping label names matching regular expressions.
+	Regex []LabelMappingRule `json:"regex,omitempty"`
+}
+
+// LabelMappingRule maps label names matching the Match regexp to the Replacement.
+type LabelMappingRule struct {
+	Match       string `json:"match"`
+	Replacement string `json:"replacement"`
+}
+
+// labelMappingPresets contains mappings from labels set by Promtail or Grafana Alloy Kubernetes discovery
+// and by Loki OTLP ingestion to fields created by other log shippers in VictoriaLogs.
+var labelMappingPresets = map[string]*LabelMapping{
+	// Vector kubernetes_logs source.
+	"vector": {
+		Exact: map[string]string{
+			"namespace": "kubernetes.pod_namespace",
+			"pod":       "kubernetes.pod_name",
+			"container": "kubernetes.container_name",
+			"node_name": "kubernetes.pod_node_name",
+		},
+	},
+	// Fluent Bit kubernetes filter.
+	"fluent-bit": {
+		Exact: map[string]string{
+			"namespace": "kubernetes.namespace_name",
+			"pod":       "kubernetes.pod_name",
+			"container": "kubernetes.container_name",
+			"node_name": "kubernetes.host",
+		},
+	},
+	// OpenTelemetry Collector. Loki replaces dots in resource attribute names with underscores,
+	// while VictoriaLogs stores them as is.
+	"opentelemetry": {
+		Exact: map[string]string{
+			"namespace":               "k8s.namespace.name",
+			"pod":                     "k8s.pod.name",
+			"container":               "k8s.container.name",
+			"node_name":               "k8s.node.name",
+			"container_name":          "container.name",
+			"service_instance_id":     "service.instance.id",
+			"deployment_environment":  "deployment.environment",
+			"cloud_availability_zone": "cloud.availability_zone",
+		},
+		Regex: []LabelMappingRule{
+			{Match: `k8s_(cluster|namespace|node|pod|container|deployment|replicaset|statefulset|daemonset|job|cronjob)_(name|uid)`, Replacement: "k8s.$1.$2"},
+			{Match: `service_(name|namespace|version)`, Replacement: "service.$1"},
+			{Match: `cloud_(provider|platform|region)`, Replacement: "cloud.$1"},
+		},
+	},
+}
+
+// LabelMappingPresets returns the names of predefined label mappings.
+func LabelMappingPresets() []string {
+	names := make([]string, 0, len(labelMappingPresets))
+	for name := range labelMappingPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// labelMapper maps LogQL label names to VictoriaLogs field names. The nil mapper keeps names as is.
+type labelMapper struct {
+	exact map[string]string
+	rules []labelMapperRule
+}
+
+// labelRef is a LogQL label referenced in the query and the VictoriaLogs field it is mapped to.
+type labelRef struct {
+	label string
+	field string
+}
+
+type labelMapperRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// newLabelMapper returns the mapper for m. It returns nil if m is nil.
+func newLabelMapper(m *LabelMapping) (*labelMapper, error) {
+	if m == nil {
+		return nil, nil
+	}
+	lm := &labelMapper{exact: make(map[string]string)}
+	var rules []LabelMappingRule
+	if m.Preset != "" {
+		preset, ok := labelMappingPresets[m.Preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown label mapping preset %q; supported presets: %v", m.Preset, LabelMappingPresets())
+		}
+		for label, field := range preset.Exact {
+			lm.exact[label] = field
+		}
+		rules = preset.Regex
+	}
+	for label, field := range m.Exact {
+		lm.exact[label] = field
+	}
+	for _, r := range append(slices.Clone(m.Regex), rules...) {
+		re, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid label mapping regex %q: %w", r.Match, err)
+		}
+		lm.rules = append(lm.rules, labelMapperRule{re: re, replacement: r.Replacement})
+	}
+	return lm, nil
+}
+
+// fieldName returns the VictoriaLogs field name for the LogQL label.
+func (lm *labelMapper) fieldName(label string) string {
+	if lm == nil {
+		return label
+	}
+	if field, ok := lm.exact[label]; ok {
+		return field
+	}
+	for _, r := range lm.rules {
+		if r.re.MatchString(label) {
+			return r.re.ReplaceAllString(label, r.replacement)
+		}
+	}
+	return label
+}
+
+// fieldNames returns the VictoriaLogs field names for the LogQL labels.
+func (lm *labelMapper) fieldNames(labels []string) []string {
+	if lm == nil || len(labels) == 0 {
+		return labels
+	}
+	fields := make([]string, 0, len(labels))
+	for _, label := range labels {
+		fields = append(fields, lm.fieldName(label))
+	}
+	return fields
+}
+
+// grouping returns g with label names mapped to field names.
+func (lm *labelMapper) grouping(g *syntax.Grouping) *syntax.Grouping {
+	if lm == nil || g == nil {
+		return g
+	}
+	return &syntax.Grouping{Groups: lm.fieldNames(g.Groups), Without: g.Without}
+}
+
+// referencedLabels returns the labels referenced in expr sorted by name.
+func (tr *Translator) referencedLabels(expr syntax.Expr) []labelRef {
+	refs := make(map[labelRef]struct{})
+	add := func(names ...string) {
+		for _, name := range names {
+			refs[labelRef{label: name, field: tr.labels.fieldName(name)}] = struct{}{}
+		}
+	}
+	addMatchers := func(matchers ...*labels.Matcher) {
+		for _, m := range matchers {
+			if m != nil {
+				add(m.Name)
+			}
+		}
+	}
+	addGrouping := func(g *syntax.Grouping) {
+		if g != nil {
+			add(g.Groups...)
+		}
+	}
+	addLabelsStage := func(stage, op string) {
+		// Invalid stages are reported by the translation.
+		items, _ := labelsStageItems(stage, op)
+		for _, item := range items {
+			if item.matcher != nil {
+				addMatchers(item.matcher)
+			} else {
+				add(item.name)
+			}
+		}
+	}
+
+	expr.Walk(func(e syntax.Expr) bool {
+		switch e := e.(type) {
+		case *syntax.MatchersExpr:
+			addMatchers(e.Mts...)
+		case *syntax.LabelFilterExpr:
+			add(labelFilterNames(e.LabelFilterer)...)
+		case *syntax.LineFmtExpr:
+			add(templateLabels(e.Value)...)
+		case *syntax.LabelFmtExpr:
+			for _, f := range e.Formats {
+				add(f.Name)
+				if f.Rename {
+					add(f.Value)
+				} else {
+					add(templateLabels(f.Value)...)
+				}
+			}
+		case *syntax.DropLabelsExpr:
+			addLabelsStage(e.String(), syntax.OpDrop)
+		case *syntax.KeepLabelsExpr:
+			addLabelsStage(e.String(), syntax.OpKeep)
+		case *syntax.JSONExpressionParserExpr:
+			for _, exp := range e.Expressions {
+				add(exp.Identifier)
+			}
+		case *syntax.LogfmtExpressionParserExpr:
+			for _, exp := range e.Expressions {
+				add(exp.Identifier)
+			}
+		case *syntax.LogRangeExpr:
+			if e.Unwrap != nil {
+				add(e.Unwrap.Identifier)
+				for _, f := range e.Unwrap.PostFilters {
+					add(labelFilterNames(f)...)
+				}
+			}
+		case *syntax.RangeAggregationExpr:
+			addGrouping(e.Grouping)
+		case *syntax.VectorAggregationExpr:
+			addGrouping(e.Grouping)
+		case *syntax.BinOpExpr:
+			if m := e.Opts; m != nil && m.VectorMatching != nil {
+				add(m.VectorMatching.MatchingLabels...)
+				add(m.VectorMatching.Include...)
+			}
+		case *syntax.LabelReplaceExpr:
+			add(e.Src, e.Dst)
+		}
+		return true
+	})
+
+	result := make([]labelRef, 0, len(refs))
+	for ref := range refs {
+		result = append(result, ref)
+	}
+	slices.SortFunc(result, func(a, b labelRef) int {
+		return cmp.Or(strings.Compare(a.label, b.label), strings.Compare(a.field, b.field))
+	})
+	return result
+}
+
+// labelFilterNames returns the names of labels filtered by f.
+func labelFilterNames(f lokilog.LabelFilterer) []string {
+	switch t := f.(type) {
+	case *lokilog.BinaryLabelFilter:
+		return append(labelFilterNames(t.Left), labelFilterNames(t.Right)...)
+	case *lokilog.NumericLabelFilter:
+		return []string{t.Name}
+	case *lokilog.DurationLabelFilter:
+		return []string{t.Name}
+	case *lokilog.BytesLabelFilter:
+		return []string{t.Name}
+	case *lokilog.IPLabelFilter:
+		return []string{t.Label}
+	case *lokilog.StringLabelFilter:
+		if t.Matcher != nil {
+			return []string{t.Matcher.Name}
+		}
+	case *lokilog.LineFilterLabelFilter:
+		if t.Matcher != nil {
+			return []string{t.Matcher.Name}
+		}
+	}
+	return nil
+}
+
+// refersToField returns true if any label referenced in the query is mapped to the field.
+func (tr *Translator) refersToField(field string) bool {
+	return slices.ContainsFunc(tr.labelRefs, func(ref labelRef) bool {
+		return ref.field == field
+	})
+}
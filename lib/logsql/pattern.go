@@ -0,0 +1,276 @@
+package logsql
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logql/log/pattern"
+)
+
+// patternPlaceholder is the unnamed capture of LogQL patterns.
+const patternPlaceholder = "<_>"
+
+// patternLineFilterRegexp converts LogQL pattern line filter into the equivalent regexp.
+//
+// Loki matches every literal at its first occurrence after the previous literal without backtracking,
+// so the text before each literal must not contain the literal.
+func patternLineFilterRegexp(match string) (string, error) {
+	if _, err := pattern.ParseLineFilter([]byte(match)); err != nil {
+		return "", newBadRequest(fmt.Sprintf("invalid LogQL pattern line filter %q", match), err)
+	}
+	if match == "" {
+		return "^$", nil
+	}
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	literals := strings.Split(match, patternPlaceholder)
+	for i, lit := range literals {
+		if lit == "" {
+			continue
+		}
+		// Captures before literals must be non-empty.
+		sb.WriteString(firstOccurrenceRegexp(lit, i > 0))
+	}
+	if strings.HasSuffix(match, patternPlaceholder) {
+		sb.WriteString(".+")
+	} else {
+		sb.WriteString("$")
+	}
+	return sb.String(), nil
+}
+
+// firstOccurrenceRegexp returns the regexp matching text ending with the first occurrence of lit.
+// The text before lit must be non-empty if nonEmpty is set.
+//
+// The regexp is built by eliminating the states of the string-matching automaton for lit.
+func firstOccurrenceRegexp(lit string, nonEmpty bool) string {
+	runes := []rune(lit)
+	m := len(runes)
+	var alphabet []rune
+	for _, r := range runes {
+		if !slices.Contains(alphabet, r) {
+			alphabet = append(alphabet, r)
+		}
+	}
+
+	// fail[k] is the length of the longest proper border of runes[:k+1].
+	fail := make([]int, m)
+	for k := 1; k < m; k++ {
+		j := fail[k-1]
+		for j > 0 && runes[k] != runes[j] {
+			j = fail[j-1]
+		}
+		if runes[k] == runes[j] {
+			j++
+		}
+		fail[k] = j
+	}
+	// next returns the number of matched runes of lit after reading r with k matched runes.
+	next := func(k int, r rune) int {
+		for k > 0 && runes[k] != r {
+			k = fail[k-1]
+		}
+		if runes[k] == r {
+			k++
+		}
+		return k
+	}
+
+	// States 0..m-1 hold the number of matched runes, the state m means lit is found.
+	// States m+1..2m-1 mean the text is the prefix of lit of length state-m, so lit cannot match at the start.
+	initial, final := 2*m, 2*m+1
+	g := make(patternAutomaton, 2*m+2)
+	for i := range g {
+		g[i] = make(map[int]patternRegexp)
+	}
+	addTransitions := func(from int, target func(r rune) int) {
+		targets := make(map[int][]rune)
+		for _, r := range alphabet {
+			if to := target(r); to >= 0 {
+				targets[to] = append(targets[to], r)
+			}
+		}
+		// Runes missing in lit reset the automaton to the state 0.
+		if _, ok := targets[0]; !ok {
+			targets[0] = nil
+		}
+		for to, rs := range targets {
+			g[from][to] = runeClassRegexp(alphabet, rs, to == 0)
+		}
+	}
+	for k := 0; k < m; k++ {
+		addTransitions(k, func(r rune) int {
+			return next(k, r)
+		})
+	}
+	if nonEmpty && m > 0 {
+		// The text is empty in the state m+0, i.e. in the initial state.
+		direct := func(k int) int {
+			if k == 0 {
+				return initial
+			}
+			return m + k
+		}
+		for k := 0; k < m; k++ {
+			addTransitions(direct(k), func(r rune) int {
+				switch {
+				case r != runes[k]:
+					return next(k, r)
+				case k+1 == m:
+					// lit at the start of the text leaves the capture before it empty.
+					return -1
+				default:
+					return direct(k + 1)
+				}
+			})
+		}
+	} else {
+		g[initial][0] = patternRegexp{}
+	}
+	g[m][final] = patternRegexp{}
+	return g.regexp(initial, final)
+}
+
+// patternRegexp is a regexp built by patternAutomaton.
+type patternRegexp struct {
+	s string
+	// alt is set if s must be wrapped into a group before concatenation.
+	alt bool
+	// atom is set if s may be followed by a quantifier.
+	atom bool
+}
+
+// runeClassRegexp returns the regexp matching rs runes and, if other is set, all the runes missing in alphabet.
+func runeClassRegexp(alphabet, rs []rune, other bool) patternRegexp {
+	if !other {
+		if len(rs) == 1 {
+			s := regexp.QuoteMeta(string(rs[0]))
+			return patternRegexp{s: s, atom: len(s) == 1 || len(s) == 2 && s[0] == '\\'}
+		}
+		return patternRegexp{s: "[" + runeClassChars(rs) + "]", atom: true}
+	}
+	var excluded []rune
+	for _, r := range alphabet {
+		if !slices.Contains(rs, r) {
+			excluded = append(excluded, r)
+		}
+	}
+	if len(excluded) == 0 {
+		return patternRegexp{s: ".", atom: true}
+	}
+	return patternRegexp{s: "[^" + runeClassChars(excluded) + "]", atom: true}
+}
+
+// runeClassChars returns rs escaped for a regexp character class.
+func runeClassChars(rs []rune) string {
+	var sb strings.Builder
+	for _, r := range rs {
+		if strings.ContainsRune(`\]^-[`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (a patternRegexp) group() string {
+	if a.alt {
+		return "(?:" + a.s + ")"
+	}
+	return a.s
+}
+
+func (a patternRegexp) concat(b patternRegexp) patternRegexp {
+	switch {
+	case a.s == "":
+		return b
+	case b.s == "":
+		return a
+	case b.s == a.s+"*" && a.atom:
+		return patternRegexp{s: a.s + "+"}
+	}
+	return patternRegexp{s: a.group() + b.group()}
+}
+
+func (a patternRegexp) star() patternRegexp {
+	switch {
+	case a.s == "":
+		return a
+	case a.atom:
+		return patternRegexp{s: a.s + "*"}
+	}
+	return patternRegexp{s: "(?:" + a.s + ")*"}
+}
+
+func (a patternRegexp) or(b patternRegexp) patternRegexp {
+	switch {
+	case a.s == b.s:
+		return a
+	case a.s == "":
+		return patternRegexp{s: b.group() + "?"}
+	case b.s == "":
+		return patternRegexp{s: a.group() + "?"}
+	}
+	return patternRegexp{s: a.s + "|" + b.s, alt: true}
+}
+
+// patternAutomaton holds the transitions between automaton states labeled with regexps.
+type patternAutomaton []map[int]patternRegexp
+
+// regexp eliminates all the states except initial and final ones and returns the regexp of the remaining transition.
+func (g patternAutomaton) regexp(initial, final int) string {
+	states := make([]int, 0, len(g))
+	for i := range g {
+		if i != initial && i != final {
+			states = append(states, i)
+		}
+	}
+	for len(states) > 0 {
+		// Eliminate the state with the least number of new transitions first to keep the regexp short.
+		best, bestCost := 0, -1
+		for i, q := range states {
+			in := 0
+			for p := range g {
+				if _, ok := g[p][q]; ok && p != q {
+					in++
+				}
+			}
+			out := len(g[q])
+			if _, ok := g[q][q]; ok {
+				out--
+			}
+			if cost := in * out; bestCost < 0 || cost < bestCost {
+				best, bestCost = i, cost
+			}
+		}
+		q := states[best]
+		states = slices.Delete(states, best, best+1)
+
+		loop := patternRegexp{}
+		if re, ok := g[q][q]; ok {
+			loop = re.star()
+		}
+		for p := range g {
+			in, ok := g[p][q]
+			if !ok || p == q {
+				continue
+			}
+			delete(g[p], q)
+			for _, r := range slices.Sorted(maps.Keys(g[q])) {
+				if r == q {
+					continue
+				}
+				re := in.concat(loop).concat(g[q][r])
+				if prev, ok := g[p][r]; ok {
+					re = prev.or(re)
+				}
+				g[p][r] = re
+			}
+		}
+		g[q] = nil
+	}
+	return g[initial][final].s
+}
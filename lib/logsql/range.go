@@ -0,0 +1,201 @@
+package logsql
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// RangePointField holds the index of the range query point in the rows returned by LogsQL of QueryInfo.LogsQLRange.
+const RangePointField = "_point"
+
+// ErrRangeQueryUnsupported is wrapped by QueryInfo.LogsQLRange errors for queries, which cannot be evaluated by a single LogsQL query.
+var ErrRangeQueryUnsupported = errors.New("the query cannot be evaluated at all the points of a range query by a single LogsQL query")
+
+func newRangeUnsupported(msg string) *TranslationError {
+	return &TranslationError{
+		Code:    http.StatusBadRequest,
+		Message: msg,
+		Err:     ErrRangeQueryUnsupported,
+	}
+}
+
+const (
+	// maxRangeBuckets is the maximum number of `_time` buckets of a range aggregation evaluated at all the points of a range query.
+	maxRangeBuckets = 100_000
+	// maxRangeTimeFilters is the maximum number of separate windows in the time filter of a range aggregation.
+	maxRangeTimeFilters = 100
+)
+
+// rangeBucketField and rangeShiftField are temporary fields for assigning `_time` buckets to range query points.
+const (
+	rangeBucketField = "_bucket"
+	rangeShiftField  = "_shift"
+)
+
+// rangeEvaluation contains the points of a range query, which are step apart.
+type rangeEvaluation struct {
+	points []time.Time
+	step   time.Duration
+}
+
+// withEvalRange returns a copy of tr evaluating metric queries at all the given points by a single query.
+func (tr *Translator) withEvalRange(points []time.Time, step time.Duration) *Translator {
+	c := *tr
+	c.evalRange = &rangeEvaluation{points: points, step: step}
+	return &c
+}
+
+// timeFilter returns the filter selecting logs in the (t-range-offset, t-offset] windows of all the points.
+func (re *rangeEvaluation) timeFilter(r *syntax.LogRangeExpr) string {
+	var filters []string
+	var start, end time.Time
+	for i, t := range re.points {
+		s, e := t.Add(-r.Offset-r.Interval), t.Add(-r.Offset)
+		if i > 0 && !s.After(end) {
+			end = e
+			continue
+		}
+		if i > 0 {
+			filters = append(filters, fmt.Sprintf("_time:(%s, %s]", formatTime(start), formatTime(end)))
+		}
+		start, end = s, e
+	}
+	filters = append(filters, fmt.Sprintf("_time:(%s, %s]", formatTime(start), formatTime(end)))
+	if len(filters) > maxRangeTimeFilters {
+		first := re.points[0].Add(-r.Offset - r.Interval)
+		return fmt.Sprintf("_time:(%s, %s]", formatTime(first), formatTime(end))
+	}
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return "(" + strings.Join(filters, " OR ") + ")"
+}
+
+// pointStats changes q calculating the range aggregation e with rs, so it calculates the aggregation at all the points.
+func (re *rangeEvaluation) pointStats(q *statsQuery, e *syntax.RangeAggregationExpr, rs *rangeStats) error {
+	r := e.Left
+	if rs.fn == "" || len(rs.pre) > 0 || len(rs.post) > 0 {
+		return newRangeUnsupported(fmt.Sprintf("%s cannot be calculated over `_time` buckets", e.Operation))
+	}
+	bucket := gcd(r.Interval, re.step)
+	if bucket%time.Millisecond != 0 {
+		return newRangeUnsupported("the range and the step must be multiples of 1ms")
+	}
+	// The window of a point consists of size buckets, and the windows of adjacent points start stride buckets apart.
+	size, stride := int64(r.Interval/bucket), int64(re.step/bucket)
+	if size > 1 && rs.merge == "" {
+		return newRangeUnsupported(fmt.Sprintf("%s cannot be merged over `_time` buckets, so the step %s must be a multiple of the range [%s], e.g. %s",
+			e.Operation, prommodel.Duration(re.step), prommodel.Duration(r.Interval), prommodel.Duration(r.Interval*((re.step+r.Interval-1)/r.Interval))))
+	}
+	last := int64(len(re.points) - 1)
+	if last*stride+size > maxRangeBuckets {
+		return newRangeUnsupported(fmt.Sprintf("the range [%s] and the step %s split the query into more than %d `_time` buckets; use the step, which is a multiple or a divisor of the range",
+			prommodel.Duration(r.Interval), prommodel.Duration(re.step), maxRangeBuckets))
+	}
+
+	// The first bucket starts right after the start of the first window.
+	start := re.points[0].Add(-r.Offset-r.Interval).UnixNano() + 1
+	n := int64(bucket)
+	q.by = append([]string{fmt.Sprintf("_time:%s offset %dns", prommodel.Duration(bucket), (start%n+n)%n)}, q.by...)
+	// round() drops float64 errors of `_time` in nanoseconds, and abs() drops the sign of -0.
+	bucketIndex := fmt.Sprintf("abs(round((_time - %d) / %d))", start, n)
+
+	var pipes []string
+	if size == stride {
+		pipes = append(pipes, "math "+bucketIndex+" as "+RangePointField, "delete _time")
+	} else {
+		// The bucket n belongs to the points p, for which p*stride <= n < p*stride+size.
+		pipes = append(pipes, "math "+bucketIndex+" as "+rangeBucketField)
+		first := rangeBucketField
+		if size > 1 {
+			first = fmt.Sprintf("max(0, %s - %d)", rangeBucketField, size-1)
+		}
+		point := ceilDivExpr(first, stride)
+		filter := rangeBucketField + ":>=0"
+		if shifts := min((size+stride-1)/stride, last+1); shifts > 1 {
+			pipes = append(pipes, "format "+quoteString(indexArray(shifts))+" as "+rangeShiftField, "unroll by ("+rangeShiftField+")")
+			point = "(" + point + " + " + rangeShiftField + ")"
+			filter = fmt.Sprintf("%s:<=%d %s", RangePointField, last, filter)
+		}
+		pipes = append(pipes,
+			"math "+point+" as "+RangePointField,
+			fmt.Sprintf("math (%s - %s) as %s", rangeBucketField, mulExpr(RangePointField, stride), rangeBucketField),
+			"filter "+filter,
+		)
+		if size == 1 {
+			pipes = append(pipes, "delete _time, "+rangeBucketField)
+		}
+	}
+	labels := append([]string{RangePointField}, q.labels...)
+	if size > 1 {
+		pipes = append(pipes, statsPipe(labels, rs.merge+"(value) as value"))
+	}
+	if q.divisor != "" {
+		pipes = append(pipes, mathPipe("value", "/", q.divisor))
+		q.divisor = ""
+	}
+	q.pipes = append(pipes, q.pipes...)
+	q.labels = labels
+	return nil
+}
+
+// constantSeries changes the constant query q, so it returns a series per point.
+func (re *rangeEvaluation) constantSeries(q *statsQuery) {
+	q.pipes = append(slices.Clone(q.pipes),
+		"format "+quoteString(indexArray(int64(len(re.points))))+" as "+RangePointField,
+		"unroll by ("+RangePointField+")",
+	)
+	q.labels = []string{RangePointField}
+	q.constant = nil
+}
+
+// pointGrouping returns the grouping labels by with RangePointField if series with the given labels have it.
+func pointGrouping(by, labels []string) []string {
+	if !slices.Contains(labels, RangePointField) || slices.Contains(by, RangePointField) {
+		return by
+	}
+	return append([]string{RangePointField}, by...)
+}
+
+// indexArray returns the JSON array of integers from 0 to n-1.
+func indexArray(n int64) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := range n {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(strconv.FormatInt(i, 10))
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+func ceilDivExpr(x string, n int64) string {
+	if n == 1 {
+		return x
+	}
+	return fmt.Sprintf("ceil(%s / %d)", x, n)
+}
+
+func mulExpr(x string, n int64) string {
+	if n == 1 {
+		return x
+	}
+	return fmt.Sprintf("%s * %d", x, n)
+}
+
+func gcd(a, b time.Duration) time.Duration {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
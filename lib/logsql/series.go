@@ -0,0 +1,235 @@
+package logsql
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logql/log/pattern"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// seriesIdentity describes the labels identifying series of a LogQL range aggregation.
+type seriesIdentity struct {
+	// labels identify series. `_stream` stands for all the log stream labels.
+	labels []string
+	// pipes remove the labels dropped by the pipeline from `_stream`. They must be applied before grouping by `_stream`.
+	pipes []string
+	// warning describes the difference between LogQL and the translated series identity.
+	warning string
+}
+
+// rangeSeriesIdentity returns the identity of series calculated by the range aggregation over the log selector.
+func (tr *Translator) rangeSeriesIdentity(sel syntax.LogSelectorExpr, unwrap *syntax.UnwrapExpr) (*seriesIdentity, error) {
+	var streamLabels []string
+	for _, m := range sel.Matchers() {
+		streamLabels = append(streamLabels, tr.labels.fieldName(m.Name))
+	}
+	var unwrapped string
+	if unwrap != nil {
+		unwrapped = tr.labels.fieldName(unwrap.Identifier)
+	}
+
+	hasStream := true
+	var fields, dropped []string
+	var parsers []string
+	// drop removes labels from the identity. Labels not produced by the pipeline may be log stream labels.
+	drop := func(names ...string) {
+		for _, name := range names {
+			if slices.Contains(fields, name) {
+				fields = removeLabels(fields, []string{name})
+				continue
+			}
+			if hasStream && tr.isStreamField(name) {
+				dropped = appendMissing(dropped, []string{name})
+			}
+		}
+	}
+
+	var stages syntax.MultiStageExpr
+	if p, ok := sel.(*syntax.PipelineExpr); ok {
+		stages = p.MultiStages
+	}
+	for _, stage := range stages {
+		switch s := stage.(type) {
+		case *syntax.LineParserExpr:
+			switch s.Op {
+			case syntax.OpParserTypeJSON, syntax.OpParserTypeUnpack, syntax.OpParserTypeLogfmt:
+				parsers = appendMissing(parsers, []string{s.Op})
+				fields = appendMissing(fields, tr.seriesLabelRefs(streamLabels, unwrapped))
+			case syntax.OpParserTypeRegexp:
+				re, err := regexp.Compile(s.Param)
+				if err != nil {
+					return nil, newBadRequest("invalid LogQL regexp parser expression", err)
+				}
+				for _, name := range re.SubexpNames() {
+					if name != "" {
+						fields = appendMissing(fields, []string{name})
+					}
+				}
+			case syntax.OpParserTypePattern:
+				m, err := pattern.New(s.Param)
+				if err != nil {
+					return nil, newBadRequest("invalid LogQL pattern parser expression", err)
+				}
+				fields = appendMissing(fields, m.Names())
+			}
+		case *syntax.LogfmtParserExpr:
+			parsers = appendMissing(parsers, []string{syntax.OpParserTypeLogfmt})
+			fields = appendMissing(fields, tr.seriesLabelRefs(streamLabels, unwrapped))
+		case *syntax.JSONExpressionParserExpr:
+			for _, e := range s.Expressions {
+				fields = appendMissing(fields, []string{tr.labels.fieldName(e.Identifier)})
+			}
+		case *syntax.LogfmtExpressionParserExpr:
+			for _, e := range s.Expressions {
+				fields = appendMissing(fields, []string{tr.labels.fieldName(e.Identifier)})
+			}
+		case *syntax.LabelFmtExpr:
+			for _, f := range s.Formats {
+				if f.Rename {
+					drop(tr.labels.fieldName(f.Value))
+				}
+				fields = appendMissing(fields, []string{tr.labels.fieldName(f.Name)})
+			}
+		case *syntax.DropLabelsExpr:
+			items, err := labelsStageItems(s.String(), syntax.OpDrop)
+			if err != nil {
+				return nil, err
+			}
+			// Conditional drops depend on label values, so they don't change the identity.
+			for _, item := range items {
+				if item.matcher == nil {
+					drop(tr.labels.fieldName(item.name))
+				}
+			}
+		case *syntax.KeepLabelsExpr:
+			items, err := labelsStageItems(s.String(), syntax.OpKeep)
+			if err != nil {
+				return nil, err
+			}
+			if len(items) == 0 {
+				continue
+			}
+			names := make([]string, 0, len(items))
+			for _, item := range items {
+				if item.matcher != nil {
+					names = append(names, item.matcher.Name)
+				} else {
+					names = append(names, item.name)
+				}
+			}
+			hasStream = false
+			dropped = nil
+			parsers = nil
+			// The log line and the timestamp aren't labels even if they are listed.
+			fields = removeLabels(appendMissing(nil, tr.labels.fieldNames(names)), keepBuiltinFields)
+		}
+	}
+
+	id := &seriesIdentity{}
+	if hasStream {
+		id.labels = []string{"_stream"}
+		id.pipes = streamLabelRemovalPipes(dropped, "_stream")
+	}
+	id.labels = appendMissing(id.labels, removeLabels(fields, []string{unwrapped}))
+	if len(parsers) > 0 {
+		id.warning = fmt.Sprintf("series are identified by log stream labels and the labels referenced in the query; other labels extracted by %s aren't known before the query is executed",
+			strings.Join(parsers, ", "))
+	}
+	return id, nil
+}
+
+// seriesLabelRefs returns the labels referenced in the query, which may be extracted by json, logfmt and unpack parsers.
+func (tr *Translator) seriesLabelRefs(streamLabels []string, unwrapped string) []string {
+	var refs []string
+	for _, ref := range tr.labelRefs {
+		name := ref.field
+		if strings.HasPrefix(name, "_") || name == unwrapped || slices.Contains(streamLabels, name) {
+			continue
+		}
+		refs = appendMissing(refs, []string{name})
+	}
+	return refs
+}
+
+// labelsStageItem is a label name or a label matcher of LogQL drop or keep stage.
+type labelsStageItem struct {
+	name    string
+	matcher *labels.Matcher
+}
+
+// labelsStageItems returns the items of LogQL drop or keep stage in the order they are listed.
+func labelsStageItems(stage, op string) ([]labelsStageItem, error) {
+	raw := strings.TrimSpace(strings.TrimPrefix(stage, syntax.OpPipe+" "+op))
+	var items []labelsStageItem
+	for _, part := range splitCommaOutsideQuotes(raw) {
+		item := strings.TrimSpace(part)
+		switch {
+		case item == "":
+		case strings.ContainsAny(item, "=!~"):
+			m, err := parseLabelMatcher(item)
+			if err != nil {
+				return nil, newBadRequest(fmt.Sprintf("failed to parse LogQL %s label matcher", op), err)
+			}
+			items = append(items, labelsStageItem{matcher: m})
+		case strings.ContainsAny(item, "\"`"):
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("invalid LogQL %s label; convert it manually (see logsql/logql-to-logsql.md)", op),
+			}
+		default:
+			items = append(items, labelsStageItem{name: item})
+		}
+	}
+	return items, nil
+}
+
+// streamLabelField is the temporary field for stream label values, which cannot be extracted by name.
+const streamLabelField = "_stream_label"
+
+// captureNameRegexp matches field names, which can be used as regexp capture group names.
+var captureNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// streamLabelPipes returns pipes restoring the by labels missing in the labels of series identified by `_stream`.
+func (tr *Translator) streamLabelPipes(by, labels []string) ([]string, error) {
+	if !slices.Contains(labels, "_stream") {
+		return nil, nil
+	}
+	var pipes []string
+	for _, name := range by {
+		if name == topkStreamField || slices.Contains(labels, name) {
+			continue
+		}
+		if !tr.isStreamField(name) {
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("cannot group series identified by log stream labels by %q, which isn't a log stream field; add it to by (...) of the inner aggregation", name),
+			}
+		}
+		group := name
+		if !captureNameRegexp.MatchString(name) {
+			group = streamLabelField
+		}
+		re := `[{,]` + regexp.QuoteMeta(name) + `="(?P<` + group + `>(?:[^"\\]|\\.)*)"`
+		pipes = append(pipes, "extract_regexp "+quoteString(re)+" from _stream")
+		if group != name {
+			pipes = append(pipes, "rename "+streamLabelField+" as "+quoteFieldNameIfNeeded(name))
+		}
+	}
+	return pipes, nil
+}
+
+// streamLabelRemovalPipes returns pipes removing the labels with the given names from the `_stream` label stored in streamField.
+func streamLabelRemovalPipes(names []string, streamField string) []string {
+	pipes := make([]string, 0, len(names))
+	for _, label := range names {
+		value := regexp.QuoteMeta(label) + `="(?:[^"\\]|\\.)*"`
+		re := `,` + value + `|(\{)` + value + `,?`
+		pipes = append(pipes, "replace_regexp ("+quoteString(re)+", \"$1\") at "+streamField)
+	}
+	return pipes
+}
@@ -0,0 +1,871 @@
+package logsql
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// templateFuncs contains the names of functions available in LogQL line_format and label_format templates.
+var templateFuncs = func() map[string]any {
+	m := make(map[string]any)
+	for _, name := range []string{
+		// text/template builtins
+		"and", "call", "html", "index", "slice", "js", "len", "not", "or", "print", "printf", "println", "urlquery",
+		"eq", "ge", "gt", "le", "lt", "ne",
+		// LogQL functions
+		"__line__", "__timestamp__",
+		"ToLower", "ToUpper", "Replace", "Trim", "TrimLeft", "TrimRight", "TrimPrefix", "TrimSuffix", "TrimSpace",
+		"regexReplaceAll", "regexReplaceAllLiteral", "count", "urldecode", "urlencode", "bytes", "duration", "duration_seconds",
+		"unixEpochMillis", "unixEpochNanos", "toDateInZone", "unixToTime", "alignLeft", "alignRight",
+		// sprig functions
+		"b64enc", "b64dec", "lower", "upper", "title", "trunc", "substr", "contains", "hasPrefix", "hasSuffix",
+		"indent", "nindent", "replace", "repeat", "trim", "trimAll", "trimSuffix", "trimPrefix", "int", "float64",
+		"add", "sub", "mul", "div", "mod", "addf", "subf", "mulf", "divf", "max", "min", "maxf", "minf",
+		"ceil", "floor", "round", "fromJson", "date", "toDate", "now", "unixEpoch", "default",
+	} {
+		m[name] = true
+	}
+	return m
+}()
+
+// templateFormatModifiers maps LogQL template functions to the equivalent LogsQL format placeholder modifiers.
+var templateFormatModifiers = map[string]string{
+	"ToLower":   "lc",
+	"lower":     "lc",
+	"ToUpper":   "uc",
+	"upper":     "uc",
+	"urlencode": "urlencode",
+	"urldecode": "urldecode",
+	"b64enc":    "base64encode",
+	"b64dec":    "base64decode",
+}
+
+// templateMathOps maps LogQL template math functions over floats to LogsQL math operators or functions.
+var templateMathOps = map[string]string{
+	"addf": "+",
+	"subf": "-",
+	"mulf": "*",
+	"divf": "/",
+	"maxf": "max",
+	"minf": "min",
+}
+
+// templateIntMathOps maps LogQL template math functions over integers to LogsQL math operators or functions.
+var templateIntMathOps = map[string]string{
+	"add": "+",
+	"sub": "-",
+	"mul": "*",
+	"mod": "%",
+	"max": "max",
+	"min": "min",
+}
+
+// templateIntRegexp matches strings, which are converted to integers by LogQL template math functions. Other strings are converted to 0.
+const templateIntRegexp = `^[-+]?[0-9]+(?:\.0+)?$`
+
+// templateValue is a value calculated by a LogQL template expression.
+type templateValue struct {
+	// pattern is the LogsQL format pattern producing the value.
+	pattern string
+	// field is set if the value is stored in the field as is.
+	field string
+}
+
+// templateTranslator translates LogQL line_format and label_format templates into LogsQL pipes.
+type templateTranslator struct {
+	// labels maps label names referenced by the template to field names.
+	labels *labelMapper
+
+	pipes    []string
+	temps    []string
+	warnings []string
+}
+
+// translateTemplate returns pipes storing the result of the LogQL template into the dst field.
+func translateTemplate(tmpl, dst string, labels *labelMapper) ([]string, []string, error) {
+	trees, err := parse.Parse("template", tmpl, "", "", templateFuncs)
+	if err != nil {
+		return nil, nil, newBadRequest(fmt.Sprintf("cannot parse LogQL template %q", tmpl), err)
+	}
+	t := &templateTranslator{labels: labels}
+	pattern, err := t.list(trees["template"].Root)
+	if err != nil {
+		return nil, nil, err
+	}
+	pipes := t.pipes
+	if dst == "_msg" {
+		pipes = append(pipes, "format "+quoteString(pattern))
+	} else {
+		pipes = append(pipes, "format "+quoteString(pattern)+" as "+quoteFieldNameIfNeeded(dst))
+	}
+	if len(t.temps) > 0 {
+		pipes = append(pipes, "delete "+strings.Join(t.temps, ", "))
+	}
+	return pipes, t.warnings, nil
+}
+
+// templateLabels returns the names of labels referenced in the LogQL template.
+func templateLabels(tmpl string) []string {
+	trees, err := parse.Parse("template", tmpl, "", "", templateFuncs)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			names = append(names, strings.Join(n.Ident, "."))
+		}
+	}
+	walk(trees["template"].Root)
+	return names
+}
+
+func (t *templateTranslator) newTemp() string {
+	name := fmt.Sprintf("_tmpl_%d", len(t.temps))
+	t.temps = append(t.temps, name)
+	return name
+}
+
+// materialize returns the field containing the value v.
+func (t *templateTranslator) materialize(v templateValue) string {
+	if v.field != "" {
+		return v.field
+	}
+	return t.copyToTemp(v)
+}
+
+// copyToTemp returns a temporary field containing the value v, which can be modified in place.
+func (t *templateTranslator) copyToTemp(v templateValue) string {
+	if v.field != "" && slices.Contains(t.temps, v.field) {
+		return v.field
+	}
+	tmp := t.newTemp()
+	t.pipes = append(t.pipes, "format "+quoteString(v.pattern)+" as "+tmp)
+	return tmp
+}
+
+func (t *templateTranslator) list(l *parse.ListNode) (string, error) {
+	if l == nil {
+		return "", nil
+	}
+	var sb strings.Builder
+	for _, n := range l.Nodes {
+		switch n := n.(type) {
+		case *parse.TextNode:
+			sb.WriteString(escapeFormatText(string(n.Text)))
+		case *parse.ActionNode:
+			v, err := t.pipe(n.Pipe)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(v.pattern)
+		case *parse.IfNode:
+			v, err := t.ifNode(n)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(v.pattern)
+		case *parse.CommentNode:
+		default:
+			return "", unsupportedTemplateError(fmt.Sprintf("template construct %q", n.String()))
+		}
+	}
+	return sb.String(), nil
+}
+
+func (t *templateTranslator) ifNode(n *parse.IfNode) (templateValue, error) {
+	then, err := t.list(n.List)
+	if err != nil {
+		return templateValue{}, err
+	}
+	otherwise, err := t.list(n.ElseList)
+	if err != nil {
+		return templateValue{}, err
+	}
+	cond, err := t.cond(n.Pipe)
+	if err != nil {
+		return templateValue{}, err
+	}
+	tmp := t.newTemp()
+	t.pipes = append(t.pipes, "format if ("+cond+") "+quoteString(then)+" as "+tmp)
+	if otherwise != "" {
+		t.pipes = append(t.pipes, "format if (NOT "+parenthesizeCond(cond)+") "+quoteString(otherwise)+" as "+tmp)
+	}
+	return fieldTemplateValue(tmp), nil
+}
+
+func (t *templateTranslator) pipe(p *parse.PipeNode) (templateValue, error) {
+	if len(p.Decl) > 0 {
+		return templateValue{}, unsupportedTemplateError("template variables")
+	}
+	var prev *templateValue
+	for _, cmd := range p.Cmds {
+		v, err := t.command(cmd, prev)
+		if err != nil {
+			return templateValue{}, err
+		}
+		prev = &v
+	}
+	if prev == nil {
+		return templateValue{}, unsupportedTemplateError("empty template pipeline")
+	}
+	return *prev, nil
+}
+
+// command returns the value of the template command. prev is the result of the previous command in the pipeline
+// and it is passed to the command as the last argument.
+func (t *templateTranslator) command(cmd *parse.CommandNode, prev *templateValue) (templateValue, error) {
+	fn, ok := cmd.Args[0].(*parse.IdentifierNode)
+	if !ok {
+		if len(cmd.Args) > 1 || prev != nil {
+			return templateValue{}, unsupportedTemplateError(fmt.Sprintf("template command %q", cmd.String()))
+		}
+		return t.arg(cmd.Args[0])
+	}
+	args := make([]parse.Node, 0, len(cmd.Args))
+	args = append(args, cmd.Args[1:]...)
+	values := make([]templateValue, 0, len(args)+1)
+	for _, a := range args {
+		v, err := t.arg(a)
+		if err != nil {
+			return templateValue{}, err
+		}
+		values = append(values, v)
+	}
+	if prev != nil {
+		values = append(values, *prev)
+		args = append(args, nil)
+	}
+	return t.call(fn.Ident, args, values)
+}
+
+func (t *templateTranslator) arg(n parse.Node) (templateValue, error) {
+	switch n := n.(type) {
+	case *parse.FieldNode:
+		return fieldTemplateValue(t.labels.fieldName(strings.Join(n.Ident, "."))), nil
+	case *parse.StringNode, *parse.NumberNode:
+		return literalTemplateValue(templateLiteralText(n)), nil
+	case *parse.PipeNode:
+		return t.pipe(n)
+	case *parse.IdentifierNode:
+		return t.call(n.Ident, nil, nil)
+	default:
+		return templateValue{}, unsupportedTemplateError(fmt.Sprintf("template argument %q", n.String()))
+	}
+}
+
+// call returns the value of the template function fn. args contain the argument nodes; nil node means
+// the argument is calculated by the previous pipeline command. values contain the argument values.
+func (t *templateTranslator) call(fn string, args []parse.Node, values []templateValue) (templateValue, error) {
+	checkArgs := func(n int) error {
+		if len(values) != n {
+			return &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("LogQL template function %s expects %d arguments; got %d", fn, n, len(values))}
+		}
+		return nil
+	}
+	literal := func(i int) (string, error) {
+		s, ok := args[i].(*parse.StringNode)
+		if !ok {
+			return "", unsupportedTemplateError(fmt.Sprintf("non-literal argument #%d of %s", i+1, fn))
+		}
+		return s.Text, nil
+	}
+	number := func(i int) (int, error) {
+		n, ok := args[i].(*parse.NumberNode)
+		if !ok || !n.IsInt {
+			return 0, unsupportedTemplateError(fmt.Sprintf("non-integer argument #%d of %s", i+1, fn))
+		}
+		return int(n.Int64), nil
+	}
+
+	if mod, ok := templateFormatModifiers[fn]; ok {
+		if err := checkArgs(1); err != nil {
+			return templateValue{}, err
+		}
+		return templateValue{pattern: "<" + mod + ":" + t.materialize(values[0]) + ">"}, nil
+	}
+	if op, ok := templateMathOps[fn]; ok {
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		a, b := t.mathOperand(args[0], values[0]), t.mathOperand(args[1], values[1])
+		if op == "max" || op == "min" {
+			return t.math(op + "(" + a + ", " + b + ")"), nil
+		}
+		return t.math("(" + a + " " + op + " " + b + ")"), nil
+	}
+	if op, ok := templateIntMathOps[fn]; ok {
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		a, b := t.intMathOperand(args[0], values[0]), t.intMathOperand(args[1], values[1])
+		if op == "max" || op == "min" {
+			return t.math(op + "(" + a + ", " + b + ")"), nil
+		}
+		return t.math("(" + a + " " + op + " " + b + ")"), nil
+	}
+
+	switch fn {
+	case "and", "or", "not", "eq", "ne", "lt", "le", "gt", "ge", "contains", "hasPrefix", "hasSuffix":
+		return templateValue{}, unsupportedTemplateError(fmt.Sprintf("%s outside of if condition", fn))
+	case "__line__":
+		if err := checkArgs(0); err != nil {
+			return templateValue{}, err
+		}
+		return fieldTemplateValue("_msg"), nil
+	case "__timestamp__":
+		if err := checkArgs(0); err != nil {
+			return templateValue{}, err
+		}
+		t.warnings = append(t.warnings, "__timestamp__ is formatted as RFC3339 timestamp in LogsQL")
+		return fieldTemplateValue("_time"), nil
+	case "print":
+		var sb strings.Builder
+		for _, v := range values {
+			sb.WriteString(v.pattern)
+		}
+		return templateValue{pattern: sb.String()}, nil
+	case "printf":
+		if len(values) == 0 {
+			return templateValue{}, checkArgs(1)
+		}
+		format, err := literal(0)
+		if err != nil {
+			return templateValue{}, err
+		}
+		return t.printf(format, values[1:])
+	case "len":
+		if err := checkArgs(1); err != nil {
+			return templateValue{}, err
+		}
+		tmp := t.newTemp()
+		t.pipes = append(t.pipes, "len("+quoteFieldNameIfNeeded(t.materialize(values[0]))+") as "+tmp)
+		return fieldTemplateValue(tmp), nil
+	case "TrimSpace", "trim":
+		if err := checkArgs(1); err != nil {
+			return templateValue{}, err
+		}
+		return t.replaceRegexp(values[0], `^\s+|\s+$`, ""), nil
+	case "TrimPrefix", "TrimSuffix", "trimPrefix", "trimSuffix":
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		// LogQL functions accept the string first, while sprig functions accept it last.
+		s, affixIdx := values[0], 1
+		if fn == "trimPrefix" || fn == "trimSuffix" {
+			s, affixIdx = values[1], 0
+		}
+		affix, err := literal(affixIdx)
+		if err != nil {
+			return templateValue{}, err
+		}
+		re := "^" + regexp.QuoteMeta(affix)
+		if strings.HasSuffix(strings.ToLower(fn), "suffix") {
+			re = regexp.QuoteMeta(affix) + "$"
+		}
+		return t.replaceRegexp(s, re, ""), nil
+	case "Trim", "TrimLeft", "TrimRight", "trimAll":
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		s, cutsetIdx := values[0], 1
+		if fn == "trimAll" {
+			s, cutsetIdx = values[1], 0
+		}
+		cutset, err := literal(cutsetIdx)
+		if err != nil {
+			return templateValue{}, err
+		}
+		if cutset == "" {
+			return s, nil
+		}
+		class := regexpCharClass(cutset)
+		var res []string
+		if fn != "TrimRight" {
+			res = append(res, "^"+class+"+")
+		}
+		if fn != "TrimLeft" {
+			res = append(res, class+"+$")
+		}
+		return t.replaceRegexp(s, strings.Join(res, "|"), ""), nil
+	case "replace", "Replace":
+		// strings.Replace accepts the string first, while sprig replace accepts it last.
+		var s templateValue
+		oldIdx, newIdx, limit := 0, 1, -1
+		if fn == "Replace" {
+			if err := checkArgs(4); err != nil {
+				return templateValue{}, err
+			}
+			n, err := number(3)
+			if err != nil {
+				return templateValue{}, err
+			}
+			s, oldIdx, newIdx, limit = values[0], 1, 2, n
+		} else {
+			if err := checkArgs(3); err != nil {
+				return templateValue{}, err
+			}
+			s = values[2]
+		}
+		oldStr, err := literal(oldIdx)
+		if err != nil {
+			return templateValue{}, err
+		}
+		newStr, err := literal(newIdx)
+		if err != nil {
+			return templateValue{}, err
+		}
+		if limit == 0 {
+			return s, nil
+		}
+		tmp := t.copyToTemp(s)
+		pipe := "replace (" + quoteString(oldStr) + ", " + quoteString(newStr) + ") at " + tmp
+		if limit > 0 {
+			pipe += " limit " + strconv.Itoa(limit)
+		}
+		t.pipes = append(t.pipes, pipe)
+		return fieldTemplateValue(tmp), nil
+	case "regexReplaceAll", "regexReplaceAllLiteral":
+		if err := checkArgs(3); err != nil {
+			return templateValue{}, err
+		}
+		re, err := literal(0)
+		if err != nil {
+			return templateValue{}, err
+		}
+		if _, err := regexp.Compile(re); err != nil {
+			return templateValue{}, newBadRequest(fmt.Sprintf("invalid regexp %q in LogQL template function %s", re, fn), err)
+		}
+		repl, err := literal(2)
+		if err != nil {
+			return templateValue{}, err
+		}
+		if fn == "regexReplaceAllLiteral" {
+			repl = strings.ReplaceAll(repl, "$", "$$")
+		}
+		return t.replaceRegexp(values[1], re, repl), nil
+	case "default":
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		tmp := t.copyToTemp(values[1])
+		t.pipes = append(t.pipes, "format if ("+tmp+`:="") `+quoteString(values[0].pattern)+" as "+tmp)
+		return fieldTemplateValue(tmp), nil
+	case "trunc":
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		n, err := number(0)
+		if err != nil {
+			return templateValue{}, err
+		}
+		if n >= 0 {
+			return t.substring(fn, values[1], fmt.Sprintf(`(?s)^(.{%d}).*`, n))
+		}
+		return t.substring(fn, values[1], fmt.Sprintf(`(?s)^.*?(.{%d})$`, -n))
+	case "substr":
+		if err := checkArgs(3); err != nil {
+			return templateValue{}, err
+		}
+		start, err := number(0)
+		if err != nil {
+			return templateValue{}, err
+		}
+		end, err := number(1)
+		if err != nil {
+			return templateValue{}, err
+		}
+		switch {
+		case start < 0:
+			return t.substring(fn, values[2], fmt.Sprintf(`(?s)^(.{0,%d}).*`, max(end, 0)))
+		case end < 0:
+			return t.substring(fn, values[2], fmt.Sprintf(`(?s)^.{%d}(.*)`, start))
+		default:
+			return t.substring(fn, values[2], fmt.Sprintf(`(?s)^.{%d}(.{0,%d}).*`, start, max(end-start, 0)))
+		}
+	case "div":
+		if err := checkArgs(2); err != nil {
+			return templateValue{}, err
+		}
+		// Integer division truncates the result, so the remainder is subtracted from the dividend.
+		a, b := t.intMathOperand(args[0], values[0]), t.intMathOperand(args[1], values[1])
+		return t.math("((" + a + " - " + a + " % " + b + ") / " + b + ")"), nil
+	case "ceil", "floor":
+		if err := checkArgs(1); err != nil {
+			return templateValue{}, err
+		}
+		return t.math(fn + "(" + t.mathOperand(args[0], values[0]) + ")"), nil
+	case "bytes", "duration", "duration_seconds":
+		if err := checkArgs(1); err != nil {
+			return templateValue{}, err
+		}
+		operand := t.mathOperand(args[0], values[0])
+		if fn == "bytes" {
+			return t.math(operand), nil
+		}
+		return t.math("(" + operand + " / 1000000000)"), nil
+	default:
+		return templateValue{}, unsupportedTemplateError(fmt.Sprintf("template function %q", fn))
+	}
+}
+
+// printf returns the value of printf with the given format and values. Only %s, %v, %q, %%, %d, %f and %.Nf verbs are supported.
+func (t *templateTranslator) printf(format string, values []templateValue) (templateValue, error) {
+	var sb strings.Builder
+	n := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			sb.WriteString(escapeFormatText(format[i : i+1]))
+			continue
+		}
+		// Skip flags, width and precision, which aren't supported, in order to report the whole verb.
+		j := i + 1
+		for j < len(format) && strings.IndexByte("+-# 0123456789.*[]", format[j]) >= 0 {
+			j++
+		}
+		if j == len(format) {
+			return templateValue{}, unsupportedTemplateError(fmt.Sprintf("printf format %q", format))
+		}
+		spec := format[i : j+1]
+		verb := format[j]
+		i = j
+		if spec == "%%" {
+			sb.WriteByte('%')
+			continue
+		}
+		precision, ok := printfPrecision(spec)
+		if !ok {
+			return templateValue{}, unsupportedTemplateError(fmt.Sprintf("printf verb %s", spec))
+		}
+		if n >= len(values) {
+			return templateValue{}, &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("missing printf argument for %s in %q", spec, format)}
+		}
+		v := values[n]
+		n++
+		switch verb {
+		case 's', 'v':
+			sb.WriteString(v.pattern)
+		case 'q':
+			sb.WriteString("<q:" + t.materialize(v) + ">")
+		case 'd':
+			sb.WriteString(t.math("round(" + quoteFieldNameIfNeeded(t.materialize(v)) + ")").pattern)
+		case 'f':
+			nearest := strconv.FormatFloat(math.Pow10(-precision), 'f', -1, 64)
+			sb.WriteString(t.math("round(" + quoteFieldNameIfNeeded(t.materialize(v)) + ", " + nearest + ")").pattern)
+			t.warnings = appendMissing(t.warnings, []string{fmt.Sprintf("printf %s drops trailing zeros in LogsQL", spec)})
+		default:
+			return templateValue{}, unsupportedTemplateError(fmt.Sprintf("printf verb %s", spec))
+		}
+	}
+	if n != len(values) {
+		return templateValue{}, &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("extra printf arguments for %q", format)}
+	}
+	return templateValue{pattern: sb.String()}, nil
+}
+
+// printfPrecision returns the precision of the printf verb spec. It returns false for verbs with flags or width,
+// and for precision of verbs other than %f.
+func printfPrecision(spec string) (int, bool) {
+	verb, opts := spec[len(spec)-1], spec[1:len(spec)-1]
+	switch {
+	case opts == "":
+		if verb == 'f' {
+			// The default precision of %f.
+			return 6, true
+		}
+		return 0, true
+	case verb == 'f' && strings.HasPrefix(opts, "."):
+		digits := opts[1:]
+		if digits == "" || strings.Trim(digits, "0123456789") != "" {
+			return 0, false
+		}
+		n, err := strconv.Atoi(digits)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func (t *templateTranslator) replaceRegexp(v templateValue, re, repl string) templateValue {
+	tmp := t.copyToTemp(v)
+	t.pipes = append(t.pipes, "replace_regexp ("+quoteString(re)+", "+quoteString(repl)+") at "+tmp)
+	return fieldTemplateValue(tmp)
+}
+
+// substring returns the part of v captured by the first group of re. v is returned as is if re doesn't match it.
+func (t *templateTranslator) substring(fn string, v templateValue, re string) (templateValue, error) {
+	if _, err := regexp.Compile(re); err != nil {
+		return templateValue{}, newBadRequest(fmt.Sprintf("too big arguments of LogQL template function %s", fn), err)
+	}
+	return t.replaceRegexp(v, re, "$1"), nil
+}
+
+func (t *templateTranslator) math(expr string) templateValue {
+	tmp := t.newTemp()
+	t.pipes = append(t.pipes, "math "+expr+" as "+tmp)
+	return fieldTemplateValue(tmp)
+}
+
+// mathOperand returns the math expression operand for the value v of the argument n.
+func (t *templateTranslator) mathOperand(n parse.Node, v templateValue) string {
+	if num, ok := n.(*parse.NumberNode); ok {
+		return formatMathNumber(num.Float64)
+	}
+	return quoteFieldNameIfNeeded(t.materialize(v))
+}
+
+// intMathOperand returns the math expression operand for the value v of the argument n converted to an integer.
+func (t *templateTranslator) intMathOperand(n parse.Node, v templateValue) string {
+	if num, ok := n.(*parse.NumberNode); ok {
+		return formatMathNumber(math.Trunc(num.Float64))
+	}
+	field := t.materialize(v)
+	tmp := t.newTemp()
+	t.pipes = append(t.pipes,
+		"format \"0\" as "+tmp,
+		fmt.Sprintf("format if (%s:~%s) %s as %s", quoteFieldNameIfNeeded(field), quoteString(templateIntRegexp), quoteString(fieldTemplateValue(field).pattern), tmp),
+	)
+	return tmp
+}
+
+// cond returns LogsQL filter for the template condition.
+func (t *templateTranslator) cond(p *parse.PipeNode) (string, error) {
+	if len(p.Decl) == 0 && len(p.Cmds) == 1 {
+		cmd := p.Cmds[0]
+		if fn, ok := cmd.Args[0].(*parse.IdentifierNode); ok {
+			args := cmd.Args[1:]
+			switch fn.Ident {
+			case "and", "or":
+				if len(args) < 2 {
+					return "", &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("LogQL template function %s expects at least 2 arguments", fn.Ident)}
+				}
+				conds := make([]string, 0, len(args))
+				for _, a := range args {
+					c, err := t.condArg(a)
+					if err != nil {
+						return "", err
+					}
+					conds = append(conds, parenthesizeCond(c))
+				}
+				return strings.Join(conds, " "+strings.ToUpper(fn.Ident)+" "), nil
+			case "not":
+				if len(args) != 1 {
+					return "", &TranslationError{Code: http.StatusBadRequest, Message: "LogQL template function not expects 1 argument"}
+				}
+				c, err := t.condArg(args[0])
+				if err != nil {
+					return "", err
+				}
+				return "NOT " + parenthesizeCond(c), nil
+			case "eq", "ne", "lt", "le", "gt", "ge":
+				return t.compare(fn.Ident, args)
+			case "contains", "hasPrefix", "hasSuffix":
+				if len(args) != 2 {
+					return "", &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("LogQL template function %s expects 2 arguments", fn.Ident)}
+				}
+				s, ok := args[0].(*parse.StringNode)
+				if !ok {
+					return "", unsupportedTemplateError(fmt.Sprintf("non-literal argument #1 of %s", fn.Ident))
+				}
+				v, err := t.arg(args[1])
+				if err != nil {
+					return "", err
+				}
+				re := regexp.QuoteMeta(s.Text)
+				switch fn.Ident {
+				case "hasPrefix":
+					re = "^" + re
+				case "hasSuffix":
+					re += "$"
+				}
+				return quoteFieldNameIfNeeded(t.materialize(v)) + ":~" + quoteString(re), nil
+			}
+		}
+	}
+	// Any other value is true if it isn't empty.
+	v, err := t.pipe(p)
+	if err != nil {
+		return "", err
+	}
+	return quoteFieldNameIfNeeded(t.materialize(v)) + ":*", nil
+}
+
+func (t *templateTranslator) condArg(n parse.Node) (string, error) {
+	if p, ok := n.(*parse.PipeNode); ok {
+		return t.cond(p)
+	}
+	return t.cond(&parse.PipeNode{Cmds: []*parse.CommandNode{{Args: []parse.Node{n}}}})
+}
+
+// compare returns LogsQL filter for the template comparison function fn.
+func (t *templateTranslator) compare(fn string, args []parse.Node) (string, error) {
+	if len(args) < 2 || (fn != "eq" && len(args) != 2) {
+		return "", &TranslationError{Code: http.StatusBadRequest, Message: fmt.Sprintf("LogQL template function %s expects 2 arguments", fn)}
+	}
+	left, right := args[0], args[1:]
+	if isTemplateLiteral(left) && len(right) == 1 && !isTemplateLiteral(right[0]) {
+		// Put the field to the left side of the comparison.
+		left, right = right[0], []parse.Node{left}
+		switch fn {
+		case "lt":
+			fn = "gt"
+		case "le":
+			fn = "ge"
+		case "gt":
+			fn = "lt"
+		case "ge":
+			fn = "le"
+		}
+	}
+	if isTemplateLiteral(left) {
+		return "", unsupportedTemplateError(fmt.Sprintf("comparison of literals in %s", fn))
+	}
+	lv, err := t.arg(left)
+	if err != nil {
+		return "", err
+	}
+	field := quoteFieldNameIfNeeded(t.materialize(lv))
+
+	var conds []string
+	for _, r := range right {
+		var c string
+		switch r := r.(type) {
+		case *parse.StringNode, *parse.NumberNode:
+			value := templateLiteralText(r)
+			switch fn {
+			case "eq", "ne":
+				c = field + ":=" + quoteScalarIfNeeded(value)
+			case "lt":
+				c = field + ":<" + quoteScalarIfNeeded(value)
+			case "le":
+				c = field + ":<=" + quoteScalarIfNeeded(value)
+			case "gt":
+				c = field + ":>" + quoteScalarIfNeeded(value)
+			case "ge":
+				c = field + ":>=" + quoteScalarIfNeeded(value)
+			}
+		default:
+			if fn != "eq" && fn != "ne" {
+				return "", unsupportedTemplateError(fmt.Sprintf("comparison of two fields in %s", fn))
+			}
+			rv, err := t.arg(r)
+			if err != nil {
+				return "", err
+			}
+			c = field + ":eq_field(" + quoteFieldNameIfNeeded(t.materialize(rv)) + ")"
+		}
+		conds = append(conds, c)
+	}
+	cond := strings.Join(conds, " OR ")
+	if fn == "ne" {
+		return "NOT " + parenthesizeCond(cond), nil
+	}
+	return cond, nil
+}
+
+// parenthesizeCond wraps the LogsQL filter with parentheses if it combines multiple filters.
+func parenthesizeCond(cond string) string {
+	if strings.Contains(cond, " AND ") || strings.Contains(cond, " OR ") {
+		return "(" + cond + ")"
+	}
+	return cond
+}
+
+func isTemplateLiteral(n parse.Node) bool {
+	switch n.(type) {
+	case *parse.StringNode, *parse.NumberNode:
+		return true
+	default:
+		return false
+	}
+}
+
+func templateLiteralText(n parse.Node) string {
+	switch n := n.(type) {
+	case *parse.StringNode:
+		return n.Text
+	case *parse.NumberNode:
+		return n.Text
+	default:
+		return ""
+	}
+}
+
+func fieldTemplateValue(field string) templateValue {
+	return templateValue{pattern: "<" + field + ">", field: field}
+}
+
+func literalTemplateValue(s string) templateValue {
+	return templateValue{pattern: escapeFormatText(s)}
+}
+
+// formatTextEscaper escapes literal text of LogsQL format patterns.
+var formatTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// escapeFormatText returns the text, which is copied literally by LogsQL format pattern.
+func escapeFormatText(s string) string {
+	return formatTextEscaper.Replace(s)
+}
+
+// regexpCharClass returns the regexp character class matching any of the chars.
+func regexpCharClass(chars string) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for _, r := range chars {
+		switch r {
+		case '\\', ']', '[', '^', '-':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+func unsupportedTemplateError(what string) *TranslationError {
+	return &TranslationError{
+		Code:    http.StatusBadRequest,
+		Message: fmt.Sprintf("%s isn't supported in LogQL line_format/label_format; convert it manually", what),
+	}
+}
@@ -4,16 +4,108 @@ import (
 	"fmt"
 	"net/http"
 	"regexp"
+	resyntax "regexp/syntax"
+	"slices"
 	"strconv"
 	"strings"
+	"text/scanner"
+	"time"
 
 	lokilog "github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/log/jsonexpr"
 	"github.com/grafana/loki/v3/pkg/logql/syntax"
-	prommodel "github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 )
 
+// Options configures the translation of LogQL queries.
+type Options struct {
+	// LabelMapping maps LogQL label names to VictoriaLogs field names. Label names are used as is if it is nil.
+	LabelMapping *LabelMapping
+	// StreamFields contains VictoriaLogs `_stream` fields. Stream selector matchers on other fields
+	// are translated into field filters. All the stream selector labels are considered stream fields if it is nil.
+	StreamFields []string
+	// LineFilterMode defines the translation of `|= "s"` and `!= "s"` line filters. LineFilterModeWord is used if it is empty.
+	LineFilterMode LineFilterMode
+}
+
+// LineFilterMode defines the translation of LogQL `|=` and `!=` line filters.
+type LineFilterMode string
+
+const (
+	// LineFilterModeWord translates line filters into LogsQL phrase filters such as `"err"`.
+	// They are faster, but match only whole words, so `|= "err"` doesn't match `stderr` or `error500`.
+	LineFilterModeWord LineFilterMode = "word"
+	// LineFilterModeSubstring translates line filters into LogsQL substring filters such as `*err*`,
+	// which match the same lines as LogQL does.
+	LineFilterModeSubstring LineFilterMode = "substring"
+)
+
+// Translator translates LogQL queries to LogsQL according to Options.
+type Translator struct {
+	labels *labelMapper
+	// streamFields is nil if all the labels are stream fields.
+	streamFields map[string]struct{}
+
+	lineFilterMode LineFilterMode
+
+	// windows collects the windows of range aggregations if their time filters are rendered after the translation. See timeWindows.
+	windows *timeWindows
+	// evalRange is set if the metric query is evaluated at all the points of a range query by a single query.
+	evalRange *rangeEvaluation
+
+	// labelRefs contains the labels referenced in the query sorted by name.
+	// LogQL json and unpack parsers restore Loki names for them (see json.go),
+	// and the pipeline stages set the `__error__` field only if it is referenced (see error_labels.go).
+	labelRefs []labelRef
+}
+
+// NewTranslator returns a Translator for the given options.
+func NewTranslator(opts Options) (*Translator, error) {
+	lm, err := newLabelMapper(opts.LabelMapping)
+	if err != nil {
+		return nil, err
+	}
+	switch opts.LineFilterMode {
+	case "", LineFilterModeWord, LineFilterModeSubstring:
+	default:
+		return nil, fmt.Errorf("unknown line filter mode %q; supported modes: %s, %s", opts.LineFilterMode, LineFilterModeWord, LineFilterModeSubstring)
+	}
+	tr := &Translator{labels: lm, lineFilterMode: opts.LineFilterMode}
+	return tr.WithStreamFields(opts.StreamFields), nil
+}
+
+// WithStreamFields returns a copy of tr with the given VictoriaLogs `_stream` fields. See Options.StreamFields.
+func (tr *Translator) WithStreamFields(fields []string) *Translator {
+	c := *tr
+	c.streamFields = nil
+	if fields != nil {
+		c.streamFields = make(map[string]struct{}, len(fields))
+		for _, f := range fields {
+			c.streamFields[f] = struct{}{}
+		}
+	}
+	return &c
+}
+
+// isStreamField returns true if the field is a VictoriaLogs `_stream` field.
+func (tr *Translator) isStreamField(field string) bool {
+	if tr.streamFields == nil {
+		return true
+	}
+	_, ok := tr.streamFields[field]
+	return ok
+}
+
+// defaultTranslator translates queries without options.
+var defaultTranslator = &Translator{}
+
+// TranslateLogQLToLogsQL translates the LogQL query to LogsQL using label names as is.
 func TranslateLogQLToLogsQL(query string) (*QueryInfo, error) {
+	return defaultTranslator.Translate(query)
+}
+
+// Translate translates the LogQL query to LogsQL.
+func (tr *Translator) Translate(query string) (*QueryInfo, error) {
 	q := strings.TrimSpace(query)
 	if q == "" {
 		return nil, &TranslationError{Code: http.StatusBadRequest, Message: "logql query is required"}
@@ -32,23 +124,89 @@ func TranslateLogQLToLogsQL(query string) (*QueryInfo, error) {
 		// but can be mapped to LogsQL.
 		expr, err = syntax.ParseExprWithoutValidation(q)
 		if err != nil {
+			if parser, flag := nonLogfmtParserFlag(q); flag != "" {
+				return nil, newBadRequest(fmt.Sprintf("LogQL parser flags such as --strict and --keep-empty are supported only by logfmt parser; got %s at %s parser", flag, parser), err)
+			}
 			return nil, newBadRequest("failed to parse LogQL", err)
 		}
 	}
 
+	c := *tr
+	c.labelRefs = tr.referencedLabels(expr)
+	return c.translateExpr(expr)
+}
+
+// nonLogfmtParserFlag returns the first parser flag such as --strict, which follows other parser than logfmt in the query, and the parser name.
+func nonLogfmtParserFlag(q string) (string, string) {
+	var s scanner.Scanner
+	s.Init(strings.NewReader(q))
+	s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings | scanner.ScanRawStrings
+	s.Error = func(*scanner.Scanner, string) {}
+	parser := ""
+	afterPipe := false
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		switch {
+		case tok == '|':
+			afterPipe = true
+			continue
+		case tok == scanner.Ident && afterPipe:
+			parser = ""
+			switch name := s.TokenText(); name {
+			case syntax.OpParserTypeJSON, syntax.OpParserTypeLogfmt, syntax.OpParserTypeUnpack, syntax.OpParserTypeRegexp, syntax.OpParserTypePattern:
+				parser = name
+			}
+		case tok == '-' && s.Peek() == '-':
+			s.Scan()
+			if s.Scan() != scanner.Ident || parser == "" || parser == syntax.OpParserTypeLogfmt {
+				break
+			}
+			flag := "--" + s.TokenText()
+			for s.Peek() == '-' {
+				s.Scan()
+				if s.Scan() == scanner.Ident {
+					flag += "-" + s.TokenText()
+				}
+			}
+			return parser, flag
+		}
+		afterPipe = false
+	}
+	return "", ""
+}
+
+func (tr *Translator) translateExpr(expr syntax.Expr) (*QueryInfo, error) {
 	if se, ok := expr.(syntax.SampleExpr); ok {
-		logsQL, err := translateSampleExpr(se)
+		tw := &timeWindows{}
+		c := *tr
+		c.windows = tw
+		sq, err := c.translateSampleExpr(se)
 		if err != nil {
 			return nil, err
 		}
-		return &QueryInfo{Kind: QueryKindStats, LogsQL: logsQL}, nil
+		tmpl := sq.String()
+		logsQL := tw.render(tmpl, time.Time{})
+		if sq.constant != nil {
+			return &QueryInfo{Kind: QueryKindConstant, LogsQL: logsQL, Value: *sq.constant, Warnings: sq.warnings}, nil
+		}
+		at := func(t time.Time) (string, error) {
+			return tw.render(tmpl, t), nil
+		}
+		// Evaluation at all the points of a range query needs other pipes, so the query is translated in this mode on demand.
+		inRange := func(points []time.Time, step time.Duration) (string, error) {
+			sq, err := tr.withEvalRange(points, step).translateSampleExpr(se)
+			if err != nil {
+				return "", err
+			}
+			return sq.String(), nil
+		}
+		return &QueryInfo{Kind: QueryKindStats, LogsQL: logsQL, Warnings: sq.warnings, logsQLAt: at, logsQLRange: inRange}, nil
 	}
 	if le, ok := expr.(syntax.LogSelectorExpr); ok {
-		b := newLogsQLBuilder()
+		b := newLogsQLBuilder(tr)
 		if err := b.addLogSelector(le); err != nil {
 			return nil, err
 		}
-		return &QueryInfo{Kind: QueryKindLogs, LogsQL: b.String()}, nil
+		return &QueryInfo{Kind: QueryKindLogs, LogsQL: b.String(), Warnings: b.warnings}, nil
 	}
 
 	return nil, &TranslationError{
@@ -58,12 +216,14 @@ func TranslateLogQLToLogsQL(query string) (*QueryInfo, error) {
 }
 
 type logsQLBuilder struct {
-	sb      strings.Builder
-	hasPipe bool
+	tr       *Translator
+	sb       strings.Builder
+	hasPipe  bool
+	warnings []string
 }
 
-func newLogsQLBuilder() *logsQLBuilder {
-	return &logsQLBuilder{}
+func newLogsQLBuilder(tr *Translator) *logsQLBuilder {
+	return &logsQLBuilder{tr: tr}
 }
 
 func (b *logsQLBuilder) String() string {
@@ -76,6 +236,96 @@ func (b *logsQLBuilder) addPipe(pipe string) {
 	b.sb.WriteString(pipe)
 }
 
+func (b *logsQLBuilder) addWarning(msg string) {
+	b.warnings = append(b.warnings, msg)
+}
+
+// addTemplate adds pipes storing the result of LogQL line_format/label_format template into the dst field.
+func (b *logsQLBuilder) addTemplate(tmpl, dst string) error {
+	pipes, warnings, err := translateTemplate(tmpl, dst, b.tr.labels)
+	if err != nil {
+		return err
+	}
+	for _, pipe := range pipes {
+		b.addPipe(pipe)
+	}
+	for _, w := range warnings {
+		b.addWarning(w)
+	}
+	return nil
+}
+
+// labelFormatTempPrefix is the prefix of temporary fields holding label_format template results.
+const labelFormatTempPrefix = "_label_fmt_"
+
+// addLabelFormats adds pipes for LogQL label_format stage.
+//
+// Loki evaluates all the templates over the labels set before the first template, so templates writing labels read by
+// the following templates are rendered into temporary fields, which are renamed after all the templates.
+func (b *logsQLBuilder) addLabelFormats(formats []lokilog.LabelFmt) error {
+	var renames, moves []string
+	flushRenames := func() {
+		if len(renames) > 0 {
+			b.addPipe("rename " + strings.Join(renames, ", "))
+			renames = nil
+		}
+	}
+	readLater := func(i int, names ...string) bool {
+		for _, f := range formats[i+1:] {
+			if !f.Rename && slices.ContainsFunc(templateLabels(f.Value), func(name string) bool { return slices.Contains(names, name) }) {
+				return true
+			}
+		}
+		return false
+	}
+	rendered, deferred, temps := false, false, 0
+	for i, f := range formats {
+		dst := quoteFieldNameIfNeeded(b.tr.labels.fieldName(f.Name))
+		if f.Rename {
+			rename := quoteFieldNameIfNeeded(b.tr.labels.fieldName(f.Value)) + " as " + dst
+			// Renames before the first template change the labels seen by all the templates.
+			deferred = deferred || rendered && readLater(i, f.Name, f.Value)
+			if deferred {
+				moves = append(moves, rename)
+			} else {
+				renames = append(renames, rename)
+			}
+			continue
+		}
+		flushRenames()
+		rendered = true
+		deferred = deferred || readLater(i, f.Name)
+		if !deferred {
+			if err := b.addTemplate(f.Value, b.tr.labels.fieldName(f.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		tmp := fmt.Sprintf("%s%d", labelFormatTempPrefix, temps)
+		temps++
+		if err := b.addTemplate(f.Value, tmp); err != nil {
+			return err
+		}
+		moves = append(moves, tmp+" as "+dst)
+	}
+	renames = append(renames, moves...)
+	flushRenames()
+	return nil
+}
+
+// addLabelFilter adds the filter for LogQL label filter expression.
+func (b *logsQLBuilder) addLabelFilter(f lokilog.LabelFilterer) error {
+	filter, err := b.tr.translateLabelFilterer(f)
+	if err != nil {
+		return err
+	}
+	if hasErrorDetailsFilter(f) {
+		b.addWarning(errorDetailsWarning)
+	}
+	b.addFilter(filter)
+	return nil
+}
+
 func (b *logsQLBuilder) addFilter(filter string) {
 	f := strings.TrimSpace(filter)
 	if f == "" {
@@ -96,13 +346,21 @@ func (b *logsQLBuilder) addLogSelector(expr syntax.LogSelectorExpr) error {
 func (b *logsQLBuilder) addLogSelectorWithFilters(expr syntax.LogSelectorExpr, filters []string) error {
 	switch e := expr.(type) {
 	case *syntax.MatchersExpr:
-		b.sb.WriteString(renderStreamSelector(e.Matchers()))
+		sel, err := b.tr.renderStreamSelector(e.Matchers())
+		if err != nil {
+			return err
+		}
+		b.sb.WriteString(sel)
 		for _, f := range filters {
 			b.addFilter(f)
 		}
 		return nil
 	case *syntax.PipelineExpr:
-		b.sb.WriteString(renderStreamSelector(e.Matchers()))
+		sel, err := b.tr.renderStreamSelector(e.Matchers())
+		if err != nil {
+			return err
+		}
+		b.sb.WriteString(sel)
 		for _, f := range filters {
 			b.addFilter(f)
 		}
@@ -120,10 +378,13 @@ func (b *logsQLBuilder) addLogSelectorWithFilters(expr syntax.LogSelectorExpr, f
 	}
 }
 
+// keepBuiltinFields contains VictoriaLogs fields, which must survive LogQL keep stage.
+var keepBuiltinFields = []string{"_time", "_msg"}
+
 func (b *logsQLBuilder) addStage(stage syntax.StageExpr) error {
 	switch s := stage.(type) {
 	case *syntax.LineFilterExpr:
-		filters, err := translateLineFilterChain(s)
+		filters, err := b.tr.translateLineFilterChain(s)
 		if err != nil {
 			return err
 		}
@@ -132,13 +393,23 @@ func (b *logsQLBuilder) addStage(stage syntax.StageExpr) error {
 		}
 		return nil
 	case *syntax.LabelFilterExpr:
-		f, err := translateLabelFilterer(s.LabelFilterer)
-		if err != nil {
-			return err
-		}
-		b.addFilter(f)
-		return nil
+		return b.addLabelFilter(s.LabelFilterer)
 	case *syntax.LineParserExpr:
+		if s.Op == syntax.OpParserTypeJSON || s.Op == syntax.OpParserTypeUnpack {
+			for _, pipe := range b.tr.jsonParserPipes(s.Op) {
+				b.addPipe(pipe)
+			}
+			b.addParserErrorWarning()
+			b.addSanitizedKeysWarning()
+			return nil
+		}
+		if s.Op == syntax.OpParserTypeLogfmt {
+			for _, pipe := range b.tr.logfmtParserPipes(false, false) {
+				b.addPipe(pipe)
+			}
+			b.addSanitizedKeysWarning()
+			return nil
+		}
 		pipe, err := translateLineParserPipe(s)
 		if err != nil {
 			return err
@@ -146,20 +417,21 @@ func (b *logsQLBuilder) addStage(stage syntax.StageExpr) error {
 		b.addPipe(pipe)
 		return nil
 	case *syntax.LogfmtParserExpr:
-		b.addPipe("unpack_logfmt")
+		for _, pipe := range b.tr.logfmtParserPipes(s.Strict, s.KeepEmpty) {
+			b.addPipe(pipe)
+		}
+		b.addSanitizedKeysWarning()
+		if s.Strict {
+			b.addStrictParserWarning()
+		}
 		return nil
 	case *syntax.DecolorizeExpr:
 		b.addPipe("decolorize")
 		return nil
 	case *syntax.DropLabelsExpr:
-		raw := strings.TrimSpace(strings.TrimPrefix(s.String(), syntax.OpPipe+" "+syntax.OpDrop))
-		raw = strings.TrimSpace(raw)
-		if raw == "" {
-			return nil
-		}
-		parts := splitCommaOutsideQuotes(raw)
-		if len(parts) == 0 {
-			return nil
+		items, err := labelsStageItems(s.String(), syntax.OpDrop)
+		if err != nil {
+			return err
 		}
 		var pendingNames []string
 		flushNames := func() {
@@ -169,124 +441,112 @@ func (b *logsQLBuilder) addStage(stage syntax.StageExpr) error {
 			b.addPipe("delete " + strings.Join(pendingNames, ", "))
 			pendingNames = nil
 		}
-		for _, part := range parts {
-			item := strings.TrimSpace(part)
-			if item == "" {
-				continue
-			}
-			if strings.ContainsAny(item, "=!~") {
+		for _, item := range items {
+			if item.matcher != nil {
 				flushNames()
-				matcher, err := parseLabelMatcher(item)
-				if err != nil {
-					return newBadRequest("failed to parse LogQL drop label matcher", err)
-				}
-				cond, err := translateLabelsMatcher(matcher)
+				cond, err := b.tr.translateLabelsMatcher(item.matcher)
 				if err != nil {
 					return err
 				}
-				b.addPipe("format if (" + cond + ") \"\" as " + quoteFieldNameIfNeeded(matcher.Name))
+				b.addPipe("format if (" + cond + ") \"\" as " + quoteFieldNameIfNeeded(b.tr.labels.fieldName(item.matcher.Name)))
 				continue
 			}
-			pendingNames = append(pendingNames, item)
+			pendingNames = append(pendingNames, quoteFieldNameIfNeeded(b.tr.labels.fieldName(item.name)))
 		}
 		flushNames()
 		return nil
 	case *syntax.KeepLabelsExpr:
-		// KeepLabelsExpr doesn't expose parsed items, so parse the string form.
-		raw := strings.TrimSpace(strings.TrimPrefix(s.String(), syntax.OpPipe+" "+syntax.OpKeep))
-		raw = strings.TrimSpace(raw)
-		if raw == "" {
-			return nil
+		items, err := labelsStageItems(s.String(), syntax.OpKeep)
+		if err != nil {
+			return err
 		}
-		parts := splitCommaOutsideQuotes(raw)
-		if len(parts) == 0 {
+		if len(items) == 0 {
 			return nil
 		}
 		var unconditional []string
-		conditional := make([]*labels.Matcher, 0, len(parts))
+		conditional := make([]*labels.Matcher, 0, len(items))
 		nameSeen := make(map[string]struct{})
-		for _, part := range parts {
-			item := strings.TrimSpace(part)
-			if item == "" {
+		for _, item := range items {
+			if item.matcher != nil {
+				conditional = append(conditional, item.matcher)
 				continue
 			}
-			if strings.ContainsAny(item, "=!~") {
-				matcher, err := parseLabelMatcher(item)
-				if err != nil {
-					return newBadRequest("failed to parse LogQL keep label matcher", err)
-				}
-				conditional = append(conditional, matcher)
+			unconditional = append(unconditional, b.tr.labels.fieldName(item.name))
+		}
+		// Loki keep affects only labels, so the log line and the timestamp are always kept.
+		// Stream labels are also stored as individual fields, so the listed ones are kept without `_stream`.
+		keepNames := make([]string, 0, len(keepBuiltinFields)+len(unconditional)+len(conditional))
+		for _, name := range keepBuiltinFields {
+			nameSeen[name] = struct{}{}
+			keepNames = append(keepNames, name)
+		}
+		for _, name := range unconditional {
+			if _, ok := nameSeen[name]; ok {
 				continue
 			}
-			if strings.ContainsAny(item, "\"`") {
-				return &TranslationError{
-					Code:    http.StatusBadRequest,
-					Message: "invalid LogQL keep label; convert it manually (see logsql/logql-to-logsql.md)",
-				}
-			}
-			unconditional = append(unconditional, item)
+			nameSeen[name] = struct{}{}
+			keepNames = append(keepNames, quoteFieldNameIfNeeded(name))
 		}
-		if len(unconditional) > 0 {
-			keepNames := make([]string, 0, len(unconditional)+len(conditional))
-			for _, name := range unconditional {
-				if _, ok := nameSeen[name]; ok {
-					continue
-				}
-				nameSeen[name] = struct{}{}
-				keepNames = append(keepNames, name)
-			}
-			for _, matcher := range conditional {
-				name := matcher.Name
-				if _, ok := nameSeen[name]; ok {
-					continue
-				}
-				nameSeen[name] = struct{}{}
-				keepNames = append(keepNames, name)
-			}
-			if len(keepNames) > 0 {
-				b.addPipe("keep " + strings.Join(keepNames, ", "))
+		for _, matcher := range conditional {
+			name := b.tr.labels.fieldName(matcher.Name)
+			if _, ok := nameSeen[name]; ok {
+				continue
 			}
+			nameSeen[name] = struct{}{}
+			keepNames = append(keepNames, quoteFieldNameIfNeeded(name))
 		}
+		b.addPipe("keep " + strings.Join(keepNames, ", "))
+		// Loki keeps the label if it is listed by name or if any of its matchers match, and drops it otherwise.
+		var condNames []string
+		conds := make(map[string][]string)
 		for _, matcher := range conditional {
-			cond, err := translateLabelsMatcher(matcher)
+			name := b.tr.labels.fieldName(matcher.Name)
+			if slices.Contains(unconditional, name) {
+				continue
+			}
+			cond, err := b.tr.translateLabelsMatcher(matcher)
 			if err != nil {
 				return err
 			}
-			pattern := "<" + matcher.Name + ">"
-			b.addPipe("format if (" + cond + ") " + quoteString(pattern) + " as " + quoteFieldNameIfNeeded(matcher.Name))
-		}
-		return nil
-	case *syntax.LineFmtExpr:
-		b.addPipe("format " + quoteString(convertLokiTemplateToLogsQLPattern(s.Value)))
-		return nil
-	case *syntax.LabelFmtExpr:
-		var renames []string
-		for _, f := range s.Formats {
-			if f.Rename {
-				renames = append(renames, fmt.Sprintf("%s as %s", quoteFieldNameIfNeeded(f.Value), quoteFieldNameIfNeeded(f.Name)))
-				continue
+			if _, ok := conds[name]; !ok {
+				condNames = append(condNames, name)
 			}
-			pattern := convertLokiTemplateToLogsQLPattern(f.Value)
-			b.addPipe("format " + quoteString(pattern) + " as " + quoteFieldNameIfNeeded(f.Name))
+			conds[name] = append(conds[name], cond)
 		}
-		if len(renames) > 0 {
-			b.addPipe("rename " + strings.Join(renames, ", "))
+		for _, name := range condNames {
+			cond := parenthesizeCond(strings.Join(conds[name], " OR "))
+			b.addPipe("format if (NOT " + cond + ") \"\" as " + quoteFieldNameIfNeeded(name))
 		}
 		return nil
+	case *syntax.LineFmtExpr:
+		return b.addTemplate(s.Value, "_msg")
+	case *syntax.LabelFmtExpr:
+		return b.addLabelFormats(s.Formats)
 	case *syntax.JSONExpressionParserExpr:
-		pipes, err := translateLabelExtractionParser("unpack_json", s.Expressions)
+		pipes, err := b.tr.translateLabelExtractionParser("unpack_json", s.Expressions)
 		if err != nil {
 			return err
 		}
+		if pipe := b.tr.jsonParserErrorPipe(); pipe != "" {
+			b.addPipe(pipe)
+			b.addParserErrorWarning()
+		}
 		for _, pipe := range pipes {
 			b.addPipe(pipe)
 		}
 		return nil
 	case *syntax.LogfmtExpressionParserExpr:
-		pipes, err := translateLabelExtractionParser("unpack_logfmt", s.Expressions)
+		pipes, err := b.tr.translateLabelExtractionParser("unpack_logfmt", s.Expressions)
 		if err != nil {
 			return err
 		}
+		// Labels are always set for the extraction expressions, so --keep-empty doesn't change the result.
+		if s.Strict {
+			if pipe := b.tr.logfmtParserErrorPipe(); pipe != "" {
+				b.addPipe(pipe)
+			}
+			b.addStrictParserWarning()
+		}
 		for _, pipe := range pipes {
 			b.addPipe(pipe)
 		}
@@ -299,28 +559,46 @@ func (b *logsQLBuilder) addStage(stage syntax.StageExpr) error {
 	}
 }
 
-func renderStreamSelector(matchers []*labels.Matcher) string {
-	if len(matchers) == 0 {
-		return "{}"
+// renderStreamSelector returns the LogsQL filters for the LogQL stream selector.
+func (tr *Translator) renderStreamSelector(matchers []*labels.Matcher) (string, error) {
+	var streamMatchers []string
+	var filters []string
+	for _, m := range matchers {
+		name := tr.labels.fieldName(m.Name)
+		if tr.isStreamField(name) {
+			streamMatchers = append(streamMatchers, quoteFieldNameIfNeeded(name)+m.Type.String()+quoteString(m.Value))
+			continue
+		}
+		f, err := tr.translateLabelsMatcher(m)
+		if err != nil {
+			return "", err
+		}
+		filters = append(filters, f)
 	}
-	var sb strings.Builder
-	sb.WriteString("{")
-	for i, m := range matchers {
-		sb.WriteString(m.String())
-		if i+1 != len(matchers) {
-			sb.WriteString(",")
+	if len(streamMatchers) == 0 && len(filters) > 0 {
+		return strings.Join(filters, " "), nil
+	}
+	return strings.TrimSpace("{" + strings.Join(streamMatchers, ",") + "} " + strings.Join(filters, " ")), nil
+}
+
+// logfmtParserPipes returns LogsQL pipes for LogQL logfmt parser with the given flags.
+func (tr *Translator) logfmtParserPipes(strict, keepEmpty bool) []string {
+	var pipes []string
+	if strict {
+		if pipe := tr.logfmtParserErrorPipe(); pipe != "" {
+			pipes = append(pipes, pipe)
 		}
 	}
-	sb.WriteString("}")
-	return sb.String()
+	if keepEmpty {
+		pipes = append(pipes, "unpack_logfmt")
+	} else {
+		pipes = append(pipes, "unpack_logfmt skip_empty_results")
+	}
+	return append(pipes, tr.logfmtLabelPipes()...)
 }
 
 func translateLineParserPipe(e *syntax.LineParserExpr) (string, error) {
 	switch e.Op {
-	case syntax.OpParserTypeJSON, syntax.OpParserTypeUnpack:
-		return "unpack_json", nil
-	case syntax.OpParserTypeLogfmt:
-		return "unpack_logfmt", nil
 	case syntax.OpParserTypeRegexp:
 		return "extract_regexp " + quoteString(e.Param), nil
 	case syntax.OpParserTypePattern:
@@ -333,13 +611,13 @@ func translateLineParserPipe(e *syntax.LineParserExpr) (string, error) {
 	}
 }
 
-func translateLineFilterChain(e *syntax.LineFilterExpr) ([]string, error) {
+func (tr *Translator) translateLineFilterChain(e *syntax.LineFilterExpr) ([]string, error) {
 	var out []string
 	for curr := e; curr != nil; curr = curr.Left {
 		if curr.IsOrChild {
 			continue
 		}
-		s, err := translateLineFilterOrGroup(curr)
+		s, err := tr.translateLineFilterOrGroup(curr)
 		if err != nil {
 			return nil, err
 		}
@@ -352,71 +630,146 @@ func translateLineFilterChain(e *syntax.LineFilterExpr) ([]string, error) {
 	return out, nil
 }
 
-func translateLineFilterOrGroup(e *syntax.LineFilterExpr) (string, error) {
-	if e.Op != "" {
-		return "", &TranslationError{
-			Code:    http.StatusBadRequest,
-			Message: fmt.Sprintf("unsupported LogQL line filter function %q", e.Op),
-		}
-	}
-
-	leaf, err := translateLineFilterLeaf(e.Ty, e.Match)
-	if err != nil {
-		return "", err
-	}
+func (tr *Translator) translateLineFilterOrGroup(e *syntax.LineFilterExpr) (string, error) {
 	if e.Or == nil {
-		return leaf, nil
+		return tr.translateLineFilterLeaf(e.Ty, e.Op, e.Match)
 	}
 
-	if e.Ty != lokilog.LineMatchEqual && e.Ty != lokilog.LineMatchRegexp && e.Ty != lokilog.LineMatchPattern {
-		return "", &TranslationError{
-			Code:    http.StatusBadRequest,
-			Message: "LogQL line filter 'or' for negative matches isn't supported yet; rewrite the query without 'or'",
-		}
-	}
-
-	parts := []string{leaf}
-	for orNode := e.Or; orNode != nil; orNode = orNode.Or {
-		p, err := translateLineFilterLeaf(orNode.Ty, orNode.Match)
+	// Negative 'or' chains exclude lines matching any of the alternatives: != "a" or "b" => NOT ("a" OR "b").
+	// The LogQL parser usually rewrites them into a chain of negative filters, so this is a fallback.
+	ty, negative := positiveLineMatchType(e.Ty)
+	parts := make([]string, 0, 2)
+	for orNode := e; orNode != nil; orNode = orNode.Or {
+		p, err := tr.translateLineFilterLeaf(ty, orNode.Op, orNode.Match)
 		if err != nil {
 			return "", err
 		}
+		if p == "" {
+			// The alternative matches all the lines.
+			if negative {
+				return emptyLogsFilter, nil
+			}
+			return "", nil
+		}
 		parts = append(parts, p)
 	}
-	return "(" + strings.Join(parts, " OR ") + ")", nil
+	group := "(" + strings.Join(parts, " OR ") + ")"
+	if negative {
+		return "NOT " + group, nil
+	}
+	return group, nil
 }
 
-func translateLineFilterLeaf(ty lokilog.LineMatchType, match string) (string, error) {
+// positiveLineMatchType returns the positive counterpart of ty and whether ty is negative.
+func positiveLineMatchType(ty lokilog.LineMatchType) (lokilog.LineMatchType, bool) {
+	switch ty {
+	case lokilog.LineMatchNotEqual:
+		return lokilog.LineMatchEqual, true
+	case lokilog.LineMatchNotRegexp:
+		return lokilog.LineMatchRegexp, true
+	case lokilog.LineMatchNotPattern:
+		return lokilog.LineMatchPattern, true
+	default:
+		return ty, false
+	}
+}
+
+func (tr *Translator) translateLineFilterLeaf(ty lokilog.LineMatchType, op, match string) (string, error) {
+	if op != "" {
+		return translateLineFilterFunc(ty, op, match)
+	}
 	switch ty {
 	case lokilog.LineMatchEqual:
-		return quoteString(match), nil
+		if match == "" {
+			// The empty substring is contained in every line, so the filter is a no-op.
+			return "", nil
+		}
+		return tr.substringLineFilter(match), nil
 	case lokilog.LineMatchNotEqual:
-		return "-" + quoteString(match), nil
+		if match == "" {
+			return emptyLogsFilter, nil
+		}
+		f := tr.substringLineFilter(match)
+		if strings.HasPrefix(f, "~") {
+			return "NOT " + f, nil
+		}
+		return "-" + f, nil
 	case lokilog.LineMatchRegexp:
 		return "~" + quoteString(match), nil
 	case lokilog.LineMatchNotRegexp:
 		return "NOT ~" + quoteString(match), nil
 	case lokilog.LineMatchPattern, lokilog.LineMatchNotPattern:
+		re, err := patternLineFilterRegexp(match)
+		if err != nil {
+			return "", err
+		}
+		if ty == lokilog.LineMatchNotPattern {
+			return "NOT ~" + quoteString(re), nil
+		}
+		return "~" + quoteString(re), nil
+	default:
 		return "", &TranslationError{
 			Code:    http.StatusBadRequest,
-			Message: "LogQL pattern line filters (|> / !>) aren't supported yet",
+			Message: fmt.Sprintf("unsupported LogQL line filter type %v", ty),
 		}
+	}
+}
+
+// substringLineFilter returns the LogsQL filter for the LogQL `|= "s"` line filter according to Options.LineFilterMode.
+func (tr *Translator) substringLineFilter(s string) string {
+	if tr.lineFilterMode != LineFilterModeSubstring {
+		return quoteString(s)
+	}
+	if isBareSubstring(s) {
+		return "*" + s + "*"
+	}
+	return "~" + quoteString(regexp.QuoteMeta(s))
+}
+
+// isBareSubstring returns true if s can be used in LogsQL substring filter `*s*` without quoting.
+func isBareSubstring(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// translateLineFilterFunc translates LogQL line filter function such as `|= ip("10.0.0.0/8")`.
+func translateLineFilterFunc(ty lokilog.LineMatchType, op, match string) (string, error) {
+	if op != syntax.OpFilterIP {
+		return "", &TranslationError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("unsupported LogQL line filter function %q", op),
+		}
+	}
+	re, err := ipLineFilterRegexp(match)
+	if err != nil {
+		return "", err
+	}
+	switch ty {
+	case lokilog.LineMatchEqual:
+		return "~" + quoteString(re), nil
+	case lokilog.LineMatchNotEqual:
+		return "NOT ~" + quoteString(re), nil
 	default:
 		return "", &TranslationError{
 			Code:    http.StatusBadRequest,
-			Message: fmt.Sprintf("unsupported LogQL line filter type %v", ty),
+			Message: "only '|=' and '!=' are supported for LogQL ip() line filter",
 		}
 	}
 }
 
-func translateLabelExtractionParser(pipe string, exprs []lokilog.LabelExtractionExpr) ([]string, error) {
+func (tr *Translator) translateLabelExtractionParser(pipe string, exprs []lokilog.LabelExtractionExpr) ([]string, error) {
 	if len(exprs) == 0 {
 		return []string{pipe}, nil
 	}
 	exprOrder := make([]string, 0, len(exprs))
-	exprSeen := make(map[string]struct{}, len(exprs))
+	exprPaths := make(map[string]*extractionPath, len(exprs))
 	exprToIDs := make(map[string][]string, len(exprs))
-	keepExpr := make(map[string]bool, len(exprs))
 	for _, exp := range exprs {
 		expr := exp.Expression
 		if expr == "" {
@@ -425,52 +778,73 @@ func translateLabelExtractionParser(pipe string, exprs []lokilog.LabelExtraction
 				Message: "empty json/logfmt extraction expression isn't supported; convert it manually (see logsql/logql-to-logsql.md)",
 			}
 		}
-		if !isSimpleExtractionField(expr) {
-			return nil, &TranslationError{
-				Code:    http.StatusBadRequest,
-				Message: "complex json/logfmt extraction expressions aren't supported yet; convert it manually (see logsql/logql-to-logsql.md)",
+		if _, ok := exprPaths[expr]; !ok {
+			path, err := newExtractionPath(pipe, expr, len(exprOrder))
+			if err != nil {
+				return nil, err
 			}
-		}
-		if _, ok := exprSeen[expr]; !ok {
-			exprSeen[expr] = struct{}{}
+			exprPaths[expr] = path
 			exprOrder = append(exprOrder, expr)
 		}
-		exprToIDs[expr] = append(exprToIDs[expr], exp.Identifier)
-		if exp.Identifier == expr {
-			keepExpr[expr] = true
-		}
+		exprToIDs[expr] = append(exprToIDs[expr], tr.labels.fieldName(exp.Identifier))
 	}
-	fields := make([]string, 0, len(exprOrder))
+
+	var fields []string
+	fieldSeen := make(map[string]struct{}, len(exprOrder))
+	keepField := make(map[string]bool, len(exprOrder))
 	for _, expr := range exprOrder {
-		fields = append(fields, quoteFieldNameIfNeeded(expr))
+		path := exprPaths[expr]
+		for _, id := range exprToIDs[expr] {
+			if id == path.result {
+				keepField[id] = true
+			}
+		}
+		if path.field == "" {
+			continue
+		}
+		if _, ok := fieldSeen[path.field]; !ok {
+			fieldSeen[path.field] = struct{}{}
+			fields = append(fields, path.field)
+		}
 	}
+
 	var pipes []string
-	pipeStr := pipe
 	if len(fields) > 0 {
-		pipeStr += " fields (" + strings.Join(fields, ", ") + ")"
+		quoted := make([]string, 0, len(fields))
+		for _, f := range fields {
+			quoted = append(quoted, quoteFieldNameIfNeeded(f))
+		}
+		pipes = append(pipes, pipe+" fields ("+strings.Join(quoted, ", ")+")")
+	}
+	for _, expr := range exprOrder {
+		pipes = append(pipes, exprPaths[expr].pipes...)
 	}
-	pipes = append(pipes, pipeStr)
 	seenFormats := make(map[string]struct{}, len(exprs))
 	for _, expr := range exprOrder {
+		result := exprPaths[expr].result
 		for _, id := range exprToIDs[expr] {
-			if id == expr {
+			if id == result {
 				continue
 			}
-			key := expr + "\x00" + id
+			key := result + "\x00" + id
 			if _, ok := seenFormats[key]; ok {
 				continue
 			}
 			seenFormats[key] = struct{}{}
-			pattern := "<" + expr + ">"
+			pattern := "<" + result + ">"
 			pipes = append(pipes, "format "+quoteString(pattern)+" as "+quoteFieldNameIfNeeded(id))
 		}
 	}
 	var drop []string
+	for _, f := range fields {
+		if !keepField[f] {
+			drop = append(drop, quoteFieldNameIfNeeded(f))
+		}
+	}
 	for _, expr := range exprOrder {
-		if keepExpr[expr] {
-			continue
+		for _, f := range exprPaths[expr].temps {
+			drop = append(drop, quoteFieldNameIfNeeded(f))
 		}
-		drop = append(drop, quoteFieldNameIfNeeded(expr))
 	}
 	if len(drop) > 0 {
 		pipes = append(pipes, "delete "+strings.Join(drop, ", "))
@@ -478,6 +852,103 @@ func translateLabelExtractionParser(pipe string, exprs []lokilog.LabelExtraction
 	return pipes, nil
 }
 
+// extractionPath describes how the value at the json/logfmt extraction expression is obtained in LogsQL.
+type extractionPath struct {
+	// field is the field extracted by the parser pipe. It is empty if the path starts at the JSON array in the log line.
+	field string
+	// pipes extract the value at the path from field into the result field.
+	pipes  []string
+	result string
+	// temps are the temporary fields created by pipes.
+	temps []string
+}
+
+// newExtractionPath returns the extraction path for the json/logfmt expression.
+func newExtractionPath(pipe, expr string, n int) (*extractionPath, error) {
+	if pipe != "unpack_json" || isSimpleExtractionField(expr) {
+		if !isSimpleExtractionField(expr) {
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: "complex logfmt extraction expressions aren't supported; convert it manually (see logsql/logql-to-logsql.md)",
+			}
+		}
+		return &extractionPath{field: expr, result: expr}, nil
+	}
+	segments, err := jsonexpr.Parse(expr, false)
+	if err != nil {
+		return nil, newBadRequest(fmt.Sprintf("cannot parse json extraction expression %q", expr), err)
+	}
+
+	keys, rest := splitJSONPathKeys(segments)
+	p := &extractionPath{field: strings.Join(keys, ".")}
+	p.result = p.field
+	src := p.field
+	if src == "" {
+		src = "_msg"
+	}
+	isString := false
+	for i := 0; len(rest) > 0; i++ {
+		if i > 0 {
+			// Elements of nested arrays may contain more levels of nesting than jsonArrayValueRegexp matches.
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("json extraction expression %q indexes nested arrays, which isn't supported; convert it manually (see logsql/logql-to-logsql.md)", expr),
+			}
+		}
+		idx := rest[0].(int)
+		tmp := fmt.Sprintf("_json_%d_%d", n, i)
+		extract := "extract_regexp " + quoteString(jsonArrayElementRegexp(idx, tmp))
+		if src != "_msg" {
+			extract += " from " + quoteFieldNameIfNeeded(src)
+		}
+		p.pipes = append(p.pipes, extract)
+		p.temps = append(p.temps, tmp)
+		src = tmp
+		isString = true
+
+		keys, rest = splitJSONPathKeys(rest[1:])
+		if len(keys) > 0 {
+			p.pipes = append(p.pipes, fmt.Sprintf("unpack_json from %s fields (%s) result_prefix %s",
+				tmp, quoteFieldNameIfNeeded(strings.Join(keys, ".")), quoteString(tmp+".")))
+			src = tmp + "." + strings.Join(keys, ".")
+			p.temps = append(p.temps, src)
+			isString = false
+		}
+	}
+	if isString {
+		// extract_regexp returns JSON strings with quotes, while LogQL returns their contents.
+		p.pipes = append(p.pipes, `replace_regexp ("^\"(.*)\"$", "$1") at `+quoteFieldNameIfNeeded(src))
+	}
+	p.result = src
+	return p, nil
+}
+
+// splitJSONPathKeys splits the parsed JSON path into leading object keys and the rest of the path.
+func splitJSONPathKeys(segments []any) ([]string, []any) {
+	var keys []string
+	for len(segments) > 0 {
+		key, ok := segments[0].(string)
+		if !ok {
+			break
+		}
+		keys = append(keys, key)
+		segments = segments[1:]
+	}
+	return keys, segments
+}
+
+// jsonArrayValueRegexp matches JSON value with at most one level of nested objects or arrays.
+const jsonArrayValueRegexp = `(?:"(?:[^"\\]|\\.)*"|\{(?:[^{}\[\]"]|"(?:[^"\\]|\\.)*")*\}|\[(?:[^{}\[\]"]|"(?:[^"\\]|\\.)*")*\]|[^\s,\[\]{}"]+)`
+
+// jsonArrayElementRegexp returns the regexp extracting the element with the given index from the JSON array into the field.
+func jsonArrayElementRegexp(idx int, field string) string {
+	re := `^\s*\[\s*`
+	if idx > 0 {
+		re += fmt.Sprintf(`(?:%s\s*,\s*){%d}`, jsonArrayValueRegexp, idx)
+	}
+	return re + "(?P<" + field + ">" + jsonArrayValueRegexp + ")"
+}
+
 func parseLabelMatcher(raw string) (*labels.Matcher, error) {
 	matchers, err := syntax.ParseMatchers("{"+raw+"}", false)
 	if err != nil {
@@ -525,36 +996,43 @@ func splitCommaOutsideQuotes(s string) []string {
 	return parts
 }
 
-func translateLabelFilterer(f lokilog.LabelFilterer) (string, error) {
+func (tr *Translator) translateLabelFilterer(f lokilog.LabelFilterer) (string, error) {
 	switch t := f.(type) {
 	case *lokilog.NoopLabelFilter:
 		return "", nil
 	case *lokilog.BinaryLabelFilter:
-		left, err := translateLabelFilterer(t.Left)
+		left, err := tr.translateLabelFilterer(t.Left)
 		if err != nil {
 			return "", err
 		}
-		right, err := translateLabelFilterer(t.Right)
+		right, err := tr.translateLabelFilterer(t.Right)
 		if err != nil {
 			return "", err
 		}
+		// Empty filters match all the logs.
+		if left == "" || right == "" {
+			if !t.And {
+				return "", nil
+			}
+			return left + right, nil
+		}
 		op := " OR "
 		if t.And {
 			op = " AND "
 		}
 		return "(" + left + op + right + ")", nil
 	case *lokilog.NumericLabelFilter:
-		return translateScalarFilter(t.Name, t.Type, formatFloat(t.Value))
+		return translateScalarFilter(tr.labels.fieldName(t.Name), t.Type, formatFloat(t.Value))
 	case *lokilog.DurationLabelFilter:
-		return translateScalarFilter(t.Name, t.Type, t.Value.String())
+		return translateScalarFilter(tr.labels.fieldName(t.Name), t.Type, t.Value.String())
 	case *lokilog.BytesLabelFilter:
-		return translateScalarFilter(t.Name, t.Type, strconv.FormatUint(t.Value, 10))
+		return translateScalarFilter(tr.labels.fieldName(t.Name), t.Type, strconv.FormatUint(t.Value, 10))
 	case *lokilog.IPLabelFilter:
-		return translateIPFilter(t.Label, t.Ty, t.Pattern)
+		return translateIPFilter(tr.labels.fieldName(t.Label), t.Ty, t.Pattern)
 	case *lokilog.StringLabelFilter:
-		return translateLabelsMatcher(t.Matcher)
+		return tr.translateLabelsMatcher(t.Matcher)
 	case *lokilog.LineFilterLabelFilter:
-		return translateLabelsMatcher(t.Matcher)
+		return tr.translateLabelsMatcher(t.Matcher)
 	default:
 		return "", &TranslationError{
 			Code:    http.StatusBadRequest,
@@ -563,20 +1041,23 @@ func translateLabelFilterer(f lokilog.LabelFilterer) (string, error) {
 	}
 }
 
-func translateLabelsMatcher(m *labels.Matcher) (string, error) {
+func (tr *Translator) translateLabelsMatcher(m *labels.Matcher) (string, error) {
 	if m == nil {
 		return "", nil
 	}
-	name := quoteFieldNameIfNeeded(m.Name)
+	name := quoteFieldNameIfNeeded(tr.labels.fieldName(m.Name))
+	if m.Name == errorDetailsLabel {
+		return translateErrorDetailsMatcher(m), nil
+	}
 	switch m.Type {
 	case labels.MatchEqual:
 		return name + ":=" + quoteScalarIfNeeded(m.Value), nil
 	case labels.MatchNotEqual:
 		return "-" + name + ":=" + quoteScalarIfNeeded(m.Value), nil
 	case labels.MatchRegexp:
-		return name + ":~" + quoteString(m.Value), nil
+		return translateRegexpMatcher(name, m.Value, false), nil
 	case labels.MatchNotRegexp:
-		return "-" + name + ":~" + quoteString(m.Value), nil
+		return translateRegexpMatcher(name, m.Value, true), nil
 	default:
 		return "", &TranslationError{
 			Code:    http.StatusBadRequest,
@@ -585,6 +1066,48 @@ func translateLabelsMatcher(m *labels.Matcher) (string, error) {
 	}
 }
 
+// translateRegexpMatcher returns the LogsQL filter for the LogQL regexp matcher on the field with the given quoted name.
+func translateRegexpMatcher(name, re string, negative bool) string {
+	prefix := ""
+	if negative {
+		prefix = "-"
+	}
+	parsed, err := resyntax.Parse(re, resyntax.Perl|resyntax.DotNL)
+	if err != nil {
+		return prefix + name + ":~" + quoteString("^(?s:"+re+")$")
+	}
+	parsed = parsed.Simplify()
+	switch {
+	case parsed.Op == resyntax.OpEmptyMatch:
+		return prefix + name + `:=""`
+	case isCaseSensitiveLiteral(parsed):
+		return prefix + name + ":=" + quoteScalarIfNeeded(string(parsed.Rune))
+	case parsed.Op == resyntax.OpAlternate && !slices.ContainsFunc(parsed.Sub, func(sub *resyntax.Regexp) bool { return !isCaseSensitiveLiteral(sub) }):
+		values := make([]string, 0, len(parsed.Sub))
+		for _, sub := range parsed.Sub {
+			values = append(values, quoteScalarIfNeeded(string(sub.Rune)))
+		}
+		return prefix + name + ":in(" + strings.Join(values, ", ") + ")"
+	case parsed.Op == resyntax.OpStar && isAnyChar(parsed.Sub[0]) && !negative:
+		return "*"
+	case parsed.Op == resyntax.OpPlus && isAnyChar(parsed.Sub[0]):
+		return prefix + name + ":*"
+	case parsed.Op == resyntax.OpConcat && len(parsed.Sub) == 2 && isCaseSensitiveLiteral(parsed.Sub[0]) &&
+		parsed.Sub[1].Op == resyntax.OpStar && isAnyChar(parsed.Sub[1].Sub[0]):
+		return prefix + name + ":=" + quoteScalarIfNeeded(string(parsed.Sub[0].Rune)) + "*"
+	default:
+		return prefix + name + ":~" + quoteString("^(?s:"+re+")$")
+	}
+}
+
+func isCaseSensitiveLiteral(re *resyntax.Regexp) bool {
+	return re.Op == resyntax.OpLiteral && re.Flags&resyntax.FoldCase == 0
+}
+
+func isAnyChar(re *resyntax.Regexp) bool {
+	return re.Op == resyntax.OpAnyChar
+}
+
 func translateScalarFilter(field string, ty lokilog.LabelFilterType, value string) (string, error) {
 	name := quoteFieldNameIfNeeded(field)
 	switch ty {
@@ -624,13 +1147,6 @@ func translateIPFilter(field string, ty lokilog.LabelFilterType, pattern string)
 	}
 }
 
-var lokiTemplateVarRe = regexp.MustCompile(`{{\s*\.\s*([a-zA-Z0-9_.:-]+)\s*}}`)
-
-func convertLokiTemplateToLogsQLPattern(s string) string {
-	// Best-effort conversion of `{{.label}}` -> `<label>`.
-	return lokiTemplateVarRe.ReplaceAllString(s, `<$1>`)
-}
-
 func quoteString(s string) string {
 	// Use Go string literal rules, which match LogsQL escaping needs well enough.
 	return strconv.Quote(s)
@@ -693,111 +1209,498 @@ func isBareScalar(s string) bool {
 	return true
 }
 
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
 func formatFloat(v float64) string {
 	return strconv.FormatFloat(v, 'f', -1, 64)
 }
 
-func translateSampleExpr(expr syntax.SampleExpr) (string, error) {
+// statsQuery is a translated LogQL sample expression.
+type statsQuery struct {
+	// source is the LogsQL query selecting logs for the stats pipe.
+	source string
+	// base and cond split source into the stream/time selector and the rest of filters.
+	// They are set only if source consists of filters, so that stats over the same base
+	// can be merged into a single stats pipe with `if (cond)` conditions.
+	base string
+	cond string
+
+	// by and fn form the `stats by (by) fn as value` pipe. The pipe is omitted if fn is empty.
+	by []string
+	fn string
+	// divisor is applied to the value calculated by fn if it isn't empty, e.g. the range duration in seconds for rate().
+	divisor string
+
+	// pipes are applied after the stats pipe.
+	pipes []string
+
+	// labels are the fields identifying series in the query output.
+	labels []string
+
+	// constant is set if the query result doesn't depend on logs.
+	constant *float64
+
+	// warnings describe the differences between the LogQL and the translated query.
+	warnings []string
+}
+
+// emptyLogsFilter is a LogsQL filter, which doesn't match any logs.
+const emptyLogsFilter = "_time:<1970-01-01T00:00:00Z"
+
+// newConstStatsQuery returns a query for a single series without labels with the given value.
+func newConstStatsQuery(v float64) *statsQuery {
+	return &statsQuery{
+		source:   emptyLogsFilter,
+		fn:       "count()",
+		pipes:    []string{"math " + formatMathNumber(v) + " as value"},
+		constant: &v,
+	}
+}
+
+func (q *statsQuery) String() string {
+	var sb strings.Builder
+	sb.WriteString(q.source)
+	if q.fn != "" {
+		sb.WriteString(" | ")
+		sb.WriteString(statsPipe(q.by, q.fn+" as value"))
+		if q.divisor != "" {
+			sb.WriteString(" | ")
+			sb.WriteString(mathPipe("value", "/", q.divisor))
+		}
+	}
+	for _, pipe := range q.pipes {
+		sb.WriteString(" | ")
+		sb.WriteString(pipe)
+	}
+	return sb.String()
+}
+
+// canMergeStats returns true if q is a single stats pipe over filtered logs,
+// so it can be merged with other stats over the same base.
+func (q *statsQuery) canMergeStats() bool {
+	return q.base != "" && q.fn != "" && len(q.pipes) == 0
+}
+
+func statsPipe(by []string, funcs string) string {
+	if len(by) == 0 {
+		return "stats " + funcs
+	}
+	return fmt.Sprintf("stats by (%s) %s", strings.Join(by, ", "), funcs)
+}
+
+func (tr *Translator) translateSampleExpr(expr syntax.SampleExpr) (*statsQuery, error) {
 	switch e := expr.(type) {
 	case *syntax.RangeAggregationExpr:
-		return translateRangeAggregation(e, nil)
+		return tr.translateRangeAggregation(e, tr.labels.grouping(e.Grouping))
 	case *syntax.VectorAggregationExpr:
-		return translateVectorAggregation(e)
+		return tr.translateVectorAggregation(e)
+	case *syntax.BinOpExpr:
+		return tr.translateBinOpExpr(e)
+	case *syntax.LiteralExpr:
+		return newConstStatsQuery(e.Val), nil
+	case *syntax.VectorExpr:
+		return newConstStatsQuery(e.Val), nil
+	case *syntax.LabelReplaceExpr:
+		return tr.translateLabelReplace(e)
 	default:
-		return "", &TranslationError{
+		return nil, &TranslationError{
 			Code:    http.StatusBadRequest,
 			Message: fmt.Sprintf("unsupported LogQL metric expression %T", expr),
 		}
 	}
 }
 
-func translateVectorAggregation(e *syntax.VectorAggregationExpr) (string, error) {
+// labelReplaceField is the temporary field for the label_replace() result.
+const labelReplaceField = "_label_replace"
+
+// translateLabelReplace translates label_replace() into pipes applied to the series of the inner query.
+func (tr *Translator) translateLabelReplace(e *syntax.LabelReplaceExpr) (*statsQuery, error) {
+	q, err := tr.translateSampleExpr(e.Left)
+	if err != nil {
+		return nil, err
+	}
+	if q.constant != nil && tr.evalRange != nil {
+		tr.evalRange.constantSeries(q)
+	}
+	srcField, dstField := tr.labels.fieldName(e.Src), tr.labels.fieldName(e.Dst)
+	// Stream labels of series identified by `_stream` are extracted from it and deleted after the replacement.
+	var srcPipes []string
+	if e.Src != "" && !slices.Contains(q.labels, srcField) {
+		srcPipes, err = tr.streamLabelPipes([]string{srcField}, q.labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+	re := "^(?:" + e.Regex + ")$"
+	q.labels = appendMissing(slices.Clone(q.labels), []string{dstField})
+	// The result has labels, so it must be calculated by VictoriaLogs.
+	q.constant = nil
+	if e.Src == "" {
+		// The empty source label name means the empty value, so the result doesn't depend on series.
+		if e.Re != nil && e.Re.MatchString("") {
+			value := e.Re.ReplaceAllString("", e.Replacement)
+			q.pipes = append(q.pipes, "format "+quoteString(escapeFormatText(value))+" as "+quoteFieldNameIfNeeded(dstField))
+		}
+		return q, nil
+	}
+	src := quoteFieldNameIfNeeded(srcField)
+	q.pipes = append(q.pipes, srcPipes...)
+	q.pipes = append(q.pipes,
+		"format "+quoteString("<"+srcField+">")+" as "+labelReplaceField,
+		"replace_regexp ("+quoteString(re)+", "+quoteString(e.Replacement)+") at "+labelReplaceField,
+		"format if ("+src+":~"+quoteString(re)+") "+quoteString("<"+labelReplaceField+">")+" as "+quoteFieldNameIfNeeded(dstField),
+		"delete "+labelReplaceField,
+	)
+	if len(srcPipes) > 0 && srcField != dstField {
+		q.pipes = append(q.pipes, "delete "+src)
+	}
+	return q, nil
+}
+
+func (tr *Translator) translateVectorAggregation(e *syntax.VectorAggregationExpr) (*statsQuery, error) {
+	grouping := tr.labels.grouping(e.Grouping)
 	switch e.Operation {
-	case syntax.OpTypeSum:
-		r, ok := e.Left.(*syntax.RangeAggregationExpr)
-		if !ok {
-			return "", &TranslationError{
-				Code:    http.StatusBadRequest,
-				Message: "only sum(<range_aggregation>) is supported for now",
-			}
+	case syntax.OpTypeSum, syntax.OpTypeAvg, syntax.OpTypeMin, syntax.OpTypeMax, syntax.OpTypeCount, syntax.OpTypeStddev, syntax.OpTypeStdvar:
+		if r, ok := e.Left.(*syntax.RangeAggregationExpr); ok && r.Grouping == nil && canFuseVectorAggregation(e.Operation, r.Operation) {
+			return tr.translateRangeAggregation(r, grouping)
+		}
+		inner, err := tr.translateAggregationInput(e.Left, grouping)
+		if err != nil {
+			return nil, err
+		}
+		if inner.constant != nil {
+			return aggregateConstant(inner, e.Operation), nil
+		}
+		g, err := translateGrouping(grouping, inner.labels, "_stream")
+		if err != nil {
+			return nil, err
 		}
-		return translateRangeAggregation(r, e.Grouping)
+		streamPipes, err := tr.streamLabelPipes(g.by, inner.labels)
+		if err != nil {
+			return nil, err
+		}
+		inner.pipes = append(inner.pipes, streamPipes...)
+		aggregateSeries(inner, e.Operation, g)
+		return inner, nil
 	case syntax.OpTypeTopK, syntax.OpTypeBottomK:
-		inner, err := translateSampleExpr(e.Left)
+		inner, err := tr.translateAggregationInput(e.Left, grouping)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if e.Grouping != nil && !e.Grouping.Singleton() {
-			return "", &TranslationError{
-				Code:    http.StatusBadRequest,
-				Message: "topk/bottomk with grouping isn't supported yet",
-			}
+		g, err := translateGrouping(grouping, inner.labels, topkStreamField)
+		if err != nil {
+			return nil, err
 		}
+		streamPipes, err := tr.streamLabelPipes(g.by, inner.labels)
+		if err != nil {
+			return nil, err
+		}
+		inner.pipes = append(inner.pipes, streamPipes...)
 		order := "value desc"
 		if e.Operation == syntax.OpTypeBottomK {
 			order = "value"
 		}
-		return inner + fmt.Sprintf(" | first %d (%s)", e.Params, order), nil
+		first := fmt.Sprintf("first %d (%s)", e.Params, order)
+		if len(g.by) > 0 {
+			first += " partition by (" + strings.Join(g.by, ", ") + ")"
+		}
+		inner.pipes = append(inner.pipes, g.pipes...)
+		inner.pipes = append(inner.pipes, first)
+		if slices.Contains(g.by, topkStreamField) {
+			inner.pipes = append(inner.pipes, "delete "+topkStreamField)
+		}
+		if g.warning != "" {
+			inner.warnings = append(inner.warnings, g.warning)
+		}
+		return inner, nil
+	case syntax.OpTypeSort, syntax.OpTypeSortDesc:
+		inner, err := tr.translateSampleExpr(e.Left)
+		if err != nil {
+			return nil, err
+		}
+		order := "value"
+		if e.Operation == syntax.OpTypeSortDesc {
+			order = "value desc"
+		}
+		inner.pipes = append(inner.pipes, "sort by ("+order+")")
+		return inner, nil
 	default:
-		return "", &TranslationError{
+		return nil, &TranslationError{
 			Code:    http.StatusBadRequest,
 			Message: fmt.Sprintf("unsupported LogQL vector aggregation %q", e.Operation),
 		}
 	}
 }
 
-func translateRangeAggregation(e *syntax.RangeAggregationExpr, grouping *syntax.Grouping) (string, error) {
+// topkStreamField holds the `_stream` label modified for grouping by topk/bottomk,
+// since they must return series with the original labels.
+const topkStreamField = "_topk_stream"
+
+// translateAggregationInput translates the series aggregated by a vector aggregation with the given grouping.
+func (tr *Translator) translateAggregationInput(expr syntax.SampleExpr, grouping *syntax.Grouping) (*statsQuery, error) {
+	r, ok := expr.(*syntax.RangeAggregationExpr)
+	if !ok || r.Grouping != nil || grouping == nil || grouping.Without || grouping.Noop() {
+		return tr.translateSampleExpr(expr)
+	}
+	id, err := tr.rangeAggregationSeriesIdentity(r)
+	if err != nil {
+		return nil, err
+	}
+	inner, err := tr.translateRangeAggregation(r, &syntax.Grouping{Groups: appendMissing(slices.Clone(id.labels), grouping.Groups)})
+	if err != nil {
+		return nil, err
+	}
+	if id.warning != "" {
+		inner.warnings = append(inner.warnings, id.warning)
+	}
+	return inner, nil
+}
+
+// canFuseVectorAggregation returns true if the vector aggregation over the range aggregation
+// can be calculated by a single stats pipe grouped by the vector aggregation labels.
+func canFuseVectorAggregation(vectorOp, rangeOp string) bool {
+	switch vectorOp {
+	case syntax.OpTypeSum:
+		switch rangeOp {
+		case syntax.OpRangeTypeCount, syntax.OpRangeTypeRate, syntax.OpRangeTypeSum,
+			syntax.OpRangeTypeBytes, syntax.OpRangeTypeBytesRate:
+			return true
+		}
+	case syntax.OpTypeMin:
+		return rangeOp == syntax.OpRangeTypeMin
+	case syntax.OpTypeMax:
+		return rangeOp == syntax.OpRangeTypeMax
+	}
+	return false
+}
+
+// seriesGrouping is a translated LogQL `by (...)` or `without (...)` clause.
+type seriesGrouping struct {
+	// by contains fields for grouping series.
+	by []string
+	// pipes must be applied to series before grouping them by the `by` fields.
+	pipes []string
+	// warning describes the difference between LogQL and the translated grouping.
+	warning string
+}
+
+// translateGrouping translates the grouping of series with the given labels.
+func translateGrouping(grouping *syntax.Grouping, labels []string, streamField string) (*seriesGrouping, error) {
+	switch {
+	case grouping == nil || grouping.Singleton():
+		return &seriesGrouping{by: pointGrouping(nil, labels)}, nil
+	case grouping.Noop():
+		return &seriesGrouping{by: labels}, nil
+	case !grouping.Without:
+		by := grouping.Groups
+		if !slices.Contains(labels, "_stream") {
+			// Series have no other labels, so grouping by them is a no-op.
+			by = slices.DeleteFunc(slices.Clone(by), func(name string) bool { return !slices.Contains(labels, name) })
+		}
+		return &seriesGrouping{by: pointGrouping(by, labels)}, nil
+	}
+
+	g := &seriesGrouping{by: removeLabels(labels, grouping.Groups)}
+	if !slices.Contains(g.by, "_stream") {
+		return g, nil
+	}
+
+	// LogsQL cannot group by all the fields except the given ones, so remove the given labels
+	// from the `_stream` field and group by it instead.
+	if streamField != "_stream" {
+		g.pipes = append(g.pipes, "format \"<_stream>\" as "+streamField)
+		g.by = slices.Clone(g.by)
+		g.by[slices.Index(g.by, "_stream")] = streamField
+	}
+	g.pipes = append(g.pipes, streamLabelRemovalPipes(grouping.Groups, streamField)...)
+	g.warning = fmt.Sprintf("without (%s) is applied to log stream labels only; other labels don't affect grouping", strings.Join(grouping.Groups, ", "))
+	return g, nil
+}
+
+// aggregateSeries adds pipes aggregating series of q according to the vector aggregation op and the grouping g.
+func aggregateSeries(q *statsQuery, op string, g *seriesGrouping) {
+	by := pointGrouping(g.by, q.labels)
+	q.pipes = append(q.pipes, g.pipes...)
+	q.pipes = append(q.pipes, vectorAggregationPipes(op, by)...)
+	q.labels = by
+	if g.warning != "" {
+		q.warnings = append(q.warnings, g.warning)
+	}
+}
+
+// aggregateConstant returns the vector aggregation op applied to the single series of the constant query q.
+func aggregateConstant(q *statsQuery, op string) *statsQuery {
+	v := *q.constant
+	switch op {
+	case syntax.OpTypeCount:
+		v = 1
+	case syntax.OpTypeStddev, syntax.OpTypeStdvar:
+		v = 0
+	}
+	c := newConstStatsQuery(v)
+	c.warnings = q.warnings
+	return c
+}
+
+// vectorAggregationPipes returns pipes aggregating the `value` field of series by the given labels.
+func vectorAggregationPipes(op string, by []string) []string {
+	switch op {
+	case syntax.OpTypeCount:
+		return []string{statsPipe(by, "count() as value")}
+	case syntax.OpTypeStddev, syntax.OpTypeStdvar:
+		return varianceStatsPipes("value", by, op == syntax.OpTypeStddev)
+	default:
+		return []string{statsPipe(by, op+"(value) as value")}
+	}
+}
+
+// varianceStatsPipes returns pipes calculating the population variance (or the standard deviation if stddev is set)
+// of the given field grouped by the given labels into the `value` field.
+func varianceStatsPipes(field string, by []string, stddev bool) []string {
+	variance := "max(0, _avg_sq - _avg * _avg)"
+	if stddev {
+		variance += " ^ 0.5"
+	}
+	return []string{
+		"math (" + field + " * " + field + ") as _sq",
+		statsPipe(by, "avg("+field+") as _avg, avg(_sq) as _avg_sq"),
+		"math (" + variance + ") as value",
+		"delete _avg, _avg_sq",
+	}
+}
+
+// rangeAggregationSeriesIdentity returns the identity of series calculated by the range aggregation e.
+func (tr *Translator) rangeAggregationSeriesIdentity(e *syntax.RangeAggregationExpr) (*seriesIdentity, error) {
 	sel, err := e.Selector()
 	if err != nil {
-		return "", newBadRequest("invalid LogQL metric expression", err)
+		return nil, newBadRequest("invalid LogQL metric expression", err)
 	}
+	return tr.rangeSeriesIdentity(sel, e.Left.Unwrap)
+}
 
-	selector := newLogsQLBuilder()
-	var selectorFilters []string
-	if tf := timeFilterFromLogRange(e.Left); tf != "" {
-		selectorFilters = append(selectorFilters, tf)
+func (tr *Translator) translateRangeAggregation(e *syntax.RangeAggregationExpr, grouping *syntax.Grouping) (*statsQuery, error) {
+	sel, err := e.Selector()
+	if err != nil {
+		return nil, newBadRequest("invalid LogQL metric expression", err)
 	}
-	if err := selector.addLogSelectorWithFilters(sel, selectorFilters); err != nil {
-		return "", err
+
+	stream, err := tr.renderStreamSelector(sel.Matchers())
+	if err != nil {
+		return nil, err
 	}
+	base := newLogsQLBuilder(tr)
+	base.sb.WriteString(stream)
+	base.addFilter(tr.timeFilterFromLogRange(e.Left))
 
+	rest := newLogsQLBuilder(tr)
+	if p, ok := sel.(*syntax.PipelineExpr); ok {
+		for _, stage := range p.MultiStages {
+			if err := rest.addStage(stage); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if pipe := tr.unwrapErrorPipe(e.Left.Unwrap); pipe != "" {
+		rest.addPipe(pipe)
+	}
+	if pipe := tr.unwrapConversionPipe(e.Left.Unwrap); pipe != "" {
+		rest.addPipe(pipe)
+	}
 	for _, pf := range postFiltersFromUnwrap(e.Left.Unwrap) {
-		f, err := translateLabelFilterer(pf)
-		if err != nil {
-			return "", err
+		if err := rest.addLabelFilter(pf); err != nil {
+			return nil, err
 		}
-		selector.addFilter(f)
 	}
 
-	by := []string{"_stream"}
+	id, err := tr.rangeSeriesIdentity(sel, e.Left.Unwrap)
+	if err != nil {
+		return nil, err
+	}
+	by := id.labels
+	if grouping == nil || grouping.Without || grouping.Noop() {
+		if id.warning != "" {
+			rest.addWarning(id.warning)
+		}
+	}
+	var groupingPipes []string
 	if grouping != nil {
-		if grouping.Without {
-			return "", &TranslationError{
-				Code:    http.StatusBadRequest,
-				Message: "grouping 'without(...)' isn't supported yet",
-			}
+		g, err := translateGrouping(grouping, id.labels, "_stream")
+		if err != nil {
+			return nil, err
 		}
-		switch {
-		case grouping.Singleton():
-			by = nil
-		case grouping.Noop():
-			by = []string{"_stream"}
-		default:
-			by = grouping.Groups
+		groupingPipes = g.pipes
+		if g.warning != "" {
+			rest.addWarning(g.warning)
 		}
+		by = g.by
+	}
+	if slices.Contains(by, "_stream") {
+		for _, pipe := range id.pipes {
+			rest.addPipe(pipe)
+		}
+	}
+	for _, pipe := range groupingPipes {
+		rest.addPipe(pipe)
 	}
 
-	stats, err := rangeAggregationToStatsPipe(e)
+	if e.Operation == syntax.OpRangeTypeAbsent {
+		// absent_over_time returns a single series for all the selected logs.
+		by = nil
+	}
+	rs, err := tr.rangeAggregationToStats(e, by)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	for _, pipe := range rs.pre {
+		rest.addPipe(pipe)
+	}
+	if rs.warning != "" {
+		rest.addWarning(rs.warning)
 	}
 
-	if len(by) > 0 {
-		selector.addPipe(fmt.Sprintf("stats by (%s) %s", strings.Join(by, ", "), stats))
+	q := &statsQuery{
+		source:   base.String(),
+		by:       by,
+		fn:       rs.fn,
+		divisor:  rs.divisor,
+		pipes:    rs.post,
+		labels:   by,
+		warnings: rest.warnings,
+	}
+	if tr.evalRange != nil {
+		if err := tr.evalRange.pointStats(q, e, rs); err != nil {
+			return nil, err
+		}
+	}
+	if cond := rest.String(); cond != "" {
+		q.source += " " + cond
+		if !rest.hasPipe {
+			q.base = base.String()
+			q.cond = cond
+		}
 	} else {
-		selector.addPipe("stats " + stats)
+		q.base = q.source
+	}
+	return q, nil
+}
+
+// unwrapConversionPipe returns the pipe converting the unwrapped field value to a number the same way as LogQL does.
+func (tr *Translator) unwrapConversionPipe(u *syntax.UnwrapExpr) string {
+	if u == nil {
+		return ""
+	}
+	field := quoteFieldNameIfNeeded(tr.labels.fieldName(u.Identifier))
+	// LogsQL math converts durations to nanoseconds and byte sizes to bytes.
+	switch u.Operation {
+	case syntax.OpConvDuration, syntax.OpConvDurationSeconds:
+		return fmt.Sprintf("math (%s / 1000000000) as %s", field, field)
+	case syntax.OpConvBytes:
+		return fmt.Sprintf("math %s as %s", field, field)
+	default:
+		return ""
 	}
-	return selector.String(), nil
 }
 
 func postFiltersFromUnwrap(u *syntax.UnwrapExpr) []lokilog.LabelFilterer {
@@ -807,57 +1710,133 @@ func postFiltersFromUnwrap(u *syntax.UnwrapExpr) []lokilog.LabelFilterer {
 	return u.PostFilters
 }
 
-func timeFilterFromLogRange(r *syntax.LogRangeExpr) string {
+// timeFilterFromLogRange returns the filter selecting logs for the range aggregation.
+func (tr *Translator) timeFilterFromLogRange(r *syntax.LogRangeExpr) string {
 	if r == nil {
 		return ""
 	}
-	filter := "_time:" + prommodel.Duration(r.Interval).String()
-	if r.Offset != 0 {
-		filter += " offset " + prommodel.Duration(r.Offset).String()
+	if tr.evalRange != nil {
+		return tr.evalRange.timeFilter(r)
+	}
+	if tr.windows != nil {
+		return tr.windows.placeholder(r)
 	}
-	return filter
+	return timeWindow{interval: r.Interval, offset: r.Offset}.filter(time.Time{})
 }
 
-func rangeAggregationToStatsPipe(e *syntax.RangeAggregationExpr) (string, error) {
+// rangeStats describes the LogsQL calculation of a LogQL range aggregation.
+type rangeStats struct {
+	// pre are pipes applied to logs before the stats pipe.
+	pre []string
+	// fn is the stats function calculating the value. The stats pipe is calculated by post pipes if fn is empty.
+	fn string
+	// divisor is applied to the fn result.
+	divisor string
+	// merge is the stats function merging fn results over adjacent time ranges, e.g. sum for count().
+	// It is empty if the results cannot be merged.
+	merge string
+	// post are pipes applied after the stats pipe.
+	post []string
+	// warning describes the difference from LogQL for approximate translations.
+	warning string
+}
+
+func (tr *Translator) rangeAggregationToStats(e *syntax.RangeAggregationExpr, by []string) (*rangeStats, error) {
+	rangeSeconds := formatFloat(e.Left.Interval.Seconds())
 	switch e.Operation {
 	case syntax.OpRangeTypeRate:
+		// LogQL rate is calculated over the range duration, while LogsQL rate() divides by the duration of the selected time range,
+		// so the rate is calculated explicitly.
 		if e.Left.Unwrap != nil {
-			return "", &TranslationError{Code: http.StatusBadRequest, Message: "rate(...| unwrap ...) isn't supported yet"}
+			return nil, &TranslationError{Code: http.StatusBadRequest, Message: "rate(...| unwrap ...) isn't supported yet"}
 		}
-		return "rate() as value", nil
+		return &rangeStats{fn: "count()", divisor: rangeSeconds, merge: "sum"}, nil
 	case syntax.OpRangeTypeCount:
 		if e.Left.Unwrap != nil {
-			return "", &TranslationError{Code: http.StatusBadRequest, Message: "count_over_time(...| unwrap ...) isn't supported yet"}
+			return nil, &TranslationError{Code: http.StatusBadRequest, Message: "count_over_time(...| unwrap ...) isn't supported yet"}
+		}
+		return &rangeStats{fn: "count()", merge: "sum"}, nil
+	case syntax.OpRangeTypeBytes, syntax.OpRangeTypeBytesRate, syntax.OpRangeTypeAbsent:
+		if e.Left.Unwrap != nil {
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("%s doesn't support unwrap", e.Operation),
+			}
+		}
+		switch e.Operation {
+		case syntax.OpRangeTypeBytes:
+			return &rangeStats{fn: "sum_len(_msg)", merge: "sum"}, nil
+		case syntax.OpRangeTypeBytesRate:
+			return &rangeStats{fn: "sum_len(_msg)", divisor: rangeSeconds, merge: "sum"}, nil
+		default:
+			// The stats pipe without grouping returns a single row with zero count if there are no logs,
+			// so the row is kept only in this case.
+			return &rangeStats{
+				fn:      "count()",
+				post:    []string{"filter value:=0", "math 1 as value"},
+				warning: "absent_over_time result has no labels",
+			}, nil
 		}
-		return "count() as value", nil
 	case syntax.OpRangeTypeAvg, syntax.OpRangeTypeSum, syntax.OpRangeTypeMin, syntax.OpRangeTypeMax:
 		if e.Left.Unwrap == nil {
-			return "", &TranslationError{
+			return nil, &TranslationError{
 				Code:    http.StatusBadRequest,
 				Message: fmt.Sprintf("%s without unwrap isn't supported", e.Operation),
 			}
 		}
-		field := quoteFieldNameIfNeeded(e.Left.Unwrap.Identifier)
-		var fn string
+		field := quoteFieldNameIfNeeded(tr.labels.fieldName(e.Left.Unwrap.Identifier))
 		switch e.Operation {
 		case syntax.OpRangeTypeAvg:
-			fn = "avg(" + field + ")"
+			return &rangeStats{fn: "avg(" + field + ")"}, nil
 		case syntax.OpRangeTypeSum:
-			fn = "sum(" + field + ")"
+			return &rangeStats{fn: "sum(" + field + ")", merge: "sum"}, nil
 		case syntax.OpRangeTypeMin:
-			fn = "min(" + field + ")"
-		case syntax.OpRangeTypeMax:
-			fn = "max(" + field + ")"
+			return &rangeStats{fn: "min(" + field + ")", merge: "min"}, nil
+		default:
+			return &rangeStats{fn: "max(" + field + ")", merge: "max"}, nil
+		}
+	case syntax.OpRangeTypeFirst, syntax.OpRangeTypeLast, syntax.OpRangeTypeStddev, syntax.OpRangeTypeStdvar, syntax.OpRangeTypeRateCounter:
+		if e.Left.Unwrap == nil {
+			return nil, &TranslationError{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("%s without unwrap isn't supported", e.Operation),
+			}
+		}
+		field := quoteFieldNameIfNeeded(tr.labels.fieldName(e.Left.Unwrap.Identifier))
+		switch e.Operation {
+		case syntax.OpRangeTypeFirst, syntax.OpRangeTypeLast:
+			// Keep only the first (or the last) log of every series, so any stats function returns its value.
+			order := "_time"
+			if e.Operation == syntax.OpRangeTypeLast {
+				order = "_time desc"
+			}
+			first := "first 1 (" + order + ")"
+			if len(by) > 0 {
+				first += " partition by (" + strings.Join(by, ", ") + ")"
+			}
+			return &rangeStats{pre: []string{first}, fn: "max(" + field + ")"}, nil
+		case syntax.OpRangeTypeStddev, syntax.OpRangeTypeStdvar:
+			return &rangeStats{post: varianceStatsPipes(field, by, e.Operation == syntax.OpRangeTypeStddev)}, nil
+		default:
+			// LogsQL has no counter functions, so the increase is calculated as the difference
+			// between the max and the min values in the range.
+			return &rangeStats{
+				post: []string{
+					statsPipe(by, "min("+field+") as _min, max("+field+") as _max"),
+					"math ((_max - _min) / " + rangeSeconds + ") as value",
+					"delete _min, _max",
+				},
+				warning: "rate_counter ignores counter resets",
+			}, nil
 		}
-		return fn + " as value", nil
 	case syntax.OpRangeTypeQuantile:
 		if e.Left.Unwrap == nil || e.Params == nil {
-			return "", &TranslationError{Code: http.StatusBadRequest, Message: "quantile_over_time requires unwrap and quantile parameter"}
+			return nil, &TranslationError{Code: http.StatusBadRequest, Message: "quantile_over_time requires unwrap and quantile parameter"}
 		}
-		field := quoteFieldNameIfNeeded(e.Left.Unwrap.Identifier)
-		return fmt.Sprintf("quantile(%s, %s) as value", formatFloat(*e.Params), field), nil
+		field := quoteFieldNameIfNeeded(tr.labels.fieldName(e.Left.Unwrap.Identifier))
+		return &rangeStats{fn: fmt.Sprintf("quantile(%s, %s)", formatFloat(*e.Params), field)}, nil
 	default:
-		return "", &TranslationError{
+		return nil, &TranslationError{
 			Code:    http.StatusBadRequest,
 			Message: fmt.Sprintf("unsupported LogQL range aggregation %q", e.Operation),
 		}
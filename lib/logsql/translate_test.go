@@ -1,6 +1,17 @@
 package logsql
 
-import "testing"
+import (
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	lokilog "github.com/grafana/loki/v3/pkg/logql/log"
+	"github.com/grafana/loki/v3/pkg/logql/log/pattern"
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+)
 
 func TestTranslateLogQuery(t *testing.T) {
 	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} |= "error"`)
@@ -36,7 +47,7 @@ func TestTranslateLogQueryWithParserAndFilter(t *testing.T) {
 	if qi.Kind != QueryKindLogs {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} | unpack_json | filter trace_id:=abcdef` {
+	if qi.LogsQL != `{app="nginx"} | unpack_json keep_original_fields | format if (trace_id:"") "<trace.id><trace-id>" as trace_id | filter trace_id:=abcdef` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -49,7 +60,7 @@ func TestTranslateConditionalDropLabel(t *testing.T) {
 	if qi.Kind != QueryKindLogs {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} | format if (foo:~"bar") "" as foo` {
+	if qi.LogsQL != `{app="nginx"} | format if (foo:=bar) "" as foo` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -62,9 +73,232 @@ func TestTranslateConditionalKeepLabel(t *testing.T) {
 	if qi.Kind != QueryKindLogs {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} | format if (foo:~"bar") "<foo>" as foo` {
+	if qi.LogsQL != `{app="nginx"} | keep _time, _msg, foo | format if (NOT foo:=bar) "" as foo` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateKeepLabelsKeepsBuiltinFields(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt | keep level, app`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} | unpack_logfmt skip_empty_results | keep _time, _msg, level, app` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateKeepLabelsMixedMatchers(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt | keep level, status="200", status="404", level="info", _msg`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} | unpack_logfmt skip_empty_results | keep _time, _msg, level, status | format if (NOT (status:=200 OR status:=404)) "" as status` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONParserNestedLabels(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (req_method) (count_over_time({app="nginx"} | json | resp_status_code>=500 [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_json keep_original_fields` +
+		` | format if (req_method:"") "<req.method><req-method>" as req_method` +
+		` | format if (resp_status_code:"") "<resp.status.code><resp_status.code><resp.status_code><resp-status-code>" as resp_status_code` +
+		` | filter resp_status_code:>=500 | stats by (req_method) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONParserExtractedLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | app_extracted="api"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} | unpack_json fields (app) result_prefix "_json_extracted."` +
+		` | format if (app:*) "<_json_extracted.app>" as app_extracted | delete _json_extracted.app` +
+		` | unpack_json keep_original_fields | filter app_extracted:=api`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateUnpackParser(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | unpack | line_format "{{.req_method}}"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} | unpack_json fields (_entry) | unpack_json if (_entry:*) keep_original_fields` +
+		` | format if (req_method:"") "<req.method><req-method>" as req_method | format if (_entry:*) "<_entry>" as _msg | delete _entry` +
+		` | format "<req_method>"`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONParserErrorFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | __error__!="JSONParserErr" | level="error"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} | format if (__error__:"" AND NOT ~"(?s)^\\s*\\{.*\\}\\s*$") "JSONParserErr" as __error__` +
+		` | unpack_json keep_original_fields | filter -__error__:=JSONParserErr | filter level:=error`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 || !strings.Contains(qi.Warnings[0], "detected approximately") {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateUnwrapErrorFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum(sum_over_time({app="nginx"} | logfmt | unwrap duration(latency) | __error__="" [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_logfmt skip_empty_results` +
+		` | format if (__error__:"" AND NOT latency:~"^[-+]?(?:0|(?:(?:[0-9]+(?:\\.[0-9]*)?|\\.[0-9]+)(?:ns|us|µs|μs|ms|s|m|h))+)$") "SampleExtractionErr" as __error__` +
+		` | math (latency / 1000000000) as latency | filter __error__:="" | stats sum(latency) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateErrorDetailsFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | __error_details__=~".*closing.*" or level="x"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} | format if (__error__:"" AND NOT ~"(?s)^\\s*\\{.*\\}\\s*$") "JSONParserErr" as __error__` +
+		` | unpack_json keep_original_fields | filter (__error__:* OR level:=x)`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 2 || qi.Warnings[0] != parserErrorWarning || qi.Warnings[1] != errorDetailsWarning {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateLogfmtParserFlags(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt --strict --keep-empty | __error__=""`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} | format if (__error__:"" AND NOT ~"^\\s*(?:[^\\s=\"]+(?:=(?:\"(?:[^\"\\\\]|\\\\.)*\"|[^\\s=\"]*))?(?:\\s+|$))*$") "LogfmtParserErr" as __error__` +
+		` | unpack_logfmt | filter __error__:=""`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if !slices.Equal(qi.Warnings, []string{strictParserWarning, parserErrorWarning}) {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateLogfmtParserNonStrictErrors(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt | __error__=""`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} | unpack_logfmt skip_empty_results | filter __error__:=""` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONParserSanitizedKey(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | user_agent="curl"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | unpack_json keep_original_fields | format if (user_agent:"") "<user.agent><user-agent>" as user_agent | filter user_agent:=curl`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if !slices.Contains(qi.Warnings, sanitizedKeysWarning) {
+		t.Fatalf("missing sanitized keys warning: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateLogfmtParserSanitizedKey(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt | user_agent="curl" | _1xx="y"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | unpack_logfmt skip_empty_results | format if (_1xx:"") "<1xx>" as _1xx` +
+		` | format if (user_agent:"") "<user.agent><user-agent>" as user_agent | filter user_agent:=curl | filter _1xx:=y`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 || qi.Warnings[0] != sanitizedKeysWarning {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateJSONParserFlagsRejected(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`{app="nginx"} | json --strict`)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "supported only by logfmt parser") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTranslateUnpackParserFlagsRejected(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`{app="nginx"} |= "--x" | unpack --keep-empty`)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if !strings.Contains(err.Error(), "got --keep-empty at unpack parser") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTranslateLogfmtStrictWithoutErrorFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt --strict | level="error"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} | unpack_logfmt skip_empty_results | filter level:=error` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
+	if len(qi.Warnings) != 1 || qi.Warnings[0] != strictParserWarning {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
 }
 
 func TestTranslateJSONExpressionParser(t *testing.T) {
@@ -106,6 +340,119 @@ func TestTranslateLogfmtExpressionParser(t *testing.T) {
 	}
 }
 
+func TestTranslateMetricSeriesIdentityExtractedLabels(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"} | regexp "(?P<method>\\w+) (?P<path>\\S+)" | label_format p=path [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | extract_regexp "(?P<method>\\w+) (?P<path>\\S+)" | rename path as p` +
+		` | stats by (_stream, method, p) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityDropStreamLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"} | logfmt level | drop app [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_logfmt fields (level) | delete app` +
+		` | replace_regexp (",app=\"(?:[^\"\\\\]|\\\\.)*\"|(\\{)app=\"(?:[^\"\\\\]|\\\\.)*\",?", "$1") at _stream` +
+		` | stats by (_stream, level) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityKeep(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"} | pattern "<method> <_> <status>" | keep status [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | extract "<method> <_> <status>" | keep _time, _msg, status | stats by (status) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityKeepBuiltinFields(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx", env="prod"} | keep app, _msg [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	// Unlisted stream labels such as env don't identify series, and the log line isn't a label.
+	expected := `{app="nginx",env="prod"} _time:5m | keep _time, _msg, app | stats by (app) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityJSONParser(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"} | json | level="error" [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_json keep_original_fields | filter level:=error | stats by (_stream, level) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 || !strings.Contains(qi.Warnings[0], "labels referenced in the query") {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityJSONParserWithoutExpressions(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"} | json [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | unpack_json keep_original_fields | stats by (_stream) count() as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 || !strings.Contains(qi.Warnings[0], "other labels extracted by json aren't known") {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityJSONParserErrorFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`rate({app="nginx"} | json | __error__="" [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if !strings.Contains(qi.LogsQL, `| stats by (_stream) count() as value`) {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if !slices.ContainsFunc(qi.Warnings, func(w string) bool { return strings.Contains(w, "labels referenced in the query") }) {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricSeriesIdentityJSONParserWithoutGrouping(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum without (level) (count_over_time({app="nginx"} | logfmt | json [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if !slices.ContainsFunc(qi.Warnings, func(w string) bool { return strings.Contains(w, "other labels extracted by logfmt, json aren't known") }) {
+		t.Fatalf("unexpected warnings: %v", qi.Warnings)
+	}
+}
+
 func TestTranslateMetricRate(t *testing.T) {
 	qi, err := TranslateLogQLToLogsQL(`rate({app="nginx"}[5m])`)
 	if err != nil {
@@ -114,7 +461,7 @@ func TestTranslateMetricRate(t *testing.T) {
 	if qi.Kind != QueryKindStats {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (_stream) rate() as value` {
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (_stream) count() as value | math (value / 300) as value` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -127,7 +474,7 @@ func TestTranslateMetricSumRate(t *testing.T) {
 	if qi.Kind != QueryKindStats {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} _time:5m | stats rate() as value` {
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats count() as value | math (value / 300) as value` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -166,7 +513,7 @@ func TestTranslateMetricSumRateByLabel(t *testing.T) {
 	if qi.Kind != QueryKindStats {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) rate() as value` {
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) count() as value | math (value / 300) as value` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -179,7 +526,7 @@ func TestTranslateMetricTopKSumRate(t *testing.T) {
 	if qi.Kind != QueryKindStats {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) rate() as value | first 5 (value desc)` {
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) count() as value | math (value / 300) as value | first 5 (value desc)` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -192,7 +539,7 @@ func TestTranslateMetricRateWithOffset(t *testing.T) {
 	if qi.Kind != QueryKindStats {
 		t.Fatalf("unexpected kind: %q", qi.Kind)
 	}
-	if qi.LogsQL != `{app="nginx"} _time:5m offset 1h | stats by (_stream) rate() as value` {
+	if qi.LogsQL != `{app="nginx"} _time:5m offset 1h | stats by (_stream) count() as value | math (value / 300) as value` {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
@@ -209,3 +556,1280 @@ func TestTranslateMetricAvgOverTimeUnwrap(t *testing.T) {
 		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
 	}
 }
+
+func TestTranslateMetricBinOpSameSelector(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum(rate({app="nginx"} |= "error" [5m])) / sum(rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats count() if ("error") as lhs, count() as rhs | filter lhs:>0 rhs:>0 | math ((lhs / 300) / (rhs / 300)) as value | delete lhs, rhs` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBinOpSameSelectorDropsMissingGroups(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`max by (app) (max_over_time({app="nginx"} |= "error" | unwrap latency [5m])) - max by (app) (max_over_time({app="nginx"} | unwrap latency [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) max(latency) if ("error") as lhs, max(latency) as rhs, count() if ("error") as _binop_lhs_samples` +
+		` | filter _binop_lhs_samples:>0 | math (lhs - rhs) as value | delete lhs, rhs, _binop_lhs_samples`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBinOpScalar(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`100 * sum by (severity) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) count() as value | math (value / 300) as value | math (100 * value) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBinOpDifferentSelectors(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (path) (rate({app="nginx"} | json | status>=500 [5m])) / sum by (path) (rate({app="nginx"} | json [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_json keep_original_fields | filter status:>=500 | stats by (path) count() as value | math (value / 300) as value | rename value as lhs` +
+		` | join by (path) ({app="nginx"} _time:5m | unpack_json keep_original_fields | stats by (path) count() as value | math (value / 300) as value | rename value as rhs | fields path, rhs) inner` +
+		` | math (lhs / rhs) as value | fields path, value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBinOpGroupLeft(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (path) (rate({app="nginx"}[5m])) / on() group_left sum(rate({app="api"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (path) count() as value | math (value / 300) as value | rename value as lhs | format "1" as _binop_key` +
+		` | join by (_binop_key) ({app="api"} _time:5m | stats count() as value | math (value / 300) as value | rename value as rhs | format "1" as _binop_key | fields _binop_key, rhs) inner` +
+		` | math (lhs / rhs) as value | fields path, value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBinOpLabelsMismatch(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`sum by (path) (rate({app="nginx"}[5m])) / sum by (host) (rate({app="nginx"}[5m]))`)
+	if err == nil {
+		t.Fatalf("expected error for binary operation with different labels")
+	}
+}
+
+func TestTranslateMetricComparisonScalar(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"}[5m])) > 10`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() as value | math (value - 10) as _binop_diff | filter _binop_diff:>0 | delete _binop_diff`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricComparisonScalarLeft(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`10 <= sum by (app) (count_over_time({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() as value | math (10 - value) as _binop_diff | filter _binop_diff:<=0 | delete _binop_diff`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricComparisonBool(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"}[5m])) != bool 0`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() as value | math (value - 0) as _binop_diff` +
+		` | format "0" as value | format if (NOT _binop_diff:range[0, 0]) "1" as value | delete _binop_diff`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricComparisonVectors(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (rate({app="nginx"} |= "error" [5m])) > sum by (app) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() if ("error") as lhs, count() as rhs | filter lhs:>0 rhs:>0` +
+		` | math ((lhs / 300) - (rhs / 300)) as _binop_diff | filter _binop_diff:>0 | math (lhs / 300) as value | delete lhs, rhs, _binop_diff`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+
+	qi, err = TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"}[5m])) == bool sum by (app) (count_over_time({app="api"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected = `{app="nginx"} _time:5m | stats by (app) count() as value | rename value as lhs` +
+		` | join by (app) ({app="api"} _time:5m | stats by (app) count() as value | rename value as rhs | fields app, rhs) inner` +
+		` | math (lhs - rhs) as _binop_diff | format "0" as value | format if (_binop_diff:range[0, 0]) "1" as value | fields app, value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricAnd(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"}[5m])) and sum by (app) (count_over_time({app="api"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() as value` +
+		` | join by (app) ({app="api"} _time:5m | stats by (app) count() as value | stats by (app) count() as _binop_matches)` +
+		` | filter _binop_matches:>0 | delete _binop_matches`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricUnlessOn(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"}[5m])) unless on (app) sum by (app, host) (count_over_time({app="api"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (app) count() as value` +
+		` | join by (app) ({app="api"} _time:5m | stats by (app, host) count() as value | stats by (app) count() as _binop_matches)` +
+		` | filter _binop_matches:"" | delete _binop_matches`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricVector(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`vector(1) + vector(1)`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindConstant {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.Value != 2 {
+		t.Fatalf("unexpected value: %v", qi.Value)
+	}
+	if qi.LogsQL != `_time:<1970-01-01T00:00:00Z | stats count() as value | math 2 as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricOrVector(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (severity) (rate({app="nginx"}[5m])) or vector(0)`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (severity) count() as value | math (value / 300) as value` +
+		` | union (_time:<1970-01-01T00:00:00Z | stats count() as value | math 0 as value | format "1" as _binop_rhs)` +
+		` | first 1 (_binop_rhs) partition by (severity) | delete _binop_rhs`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricOrOnVector(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (level) (count_over_time({app="nginx"}[5m])) or on() vector(0)`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (level) count() as value` +
+		` | union (_time:<1970-01-01T00:00:00Z | stats count() as value | math 0 as value | format "1" as _binop_key` +
+		` | join by (_binop_key) ({app="nginx"} _time:5m | stats by (level) count() as value | format "1" as _binop_key | stats by (_binop_key) count() as _binop_matches)` +
+		` | filter _binop_matches:"" | delete _binop_matches, _binop_key)`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricOrIgnoring(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (level, host) (count_over_time({app="nginx"}[5m])) or ignoring(host) sum by (level, host) (count_over_time({app="api"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (level, host) count() as value` +
+		` | union ({app="api"} _time:5m | stats by (level, host) count() as value` +
+		` | join by (level) ({app="nginx"} _time:5m | stats by (level, host) count() as value | stats by (level) count() as _binop_matches)` +
+		` | filter _binop_matches:"" | delete _binop_matches)`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricOrIgnoringStreamLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count_over_time({app="nginx"}[5m]) or ignoring(pod) count_over_time({app="api"}[5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	removePod := `replace_regexp (",pod=\"(?:[^\"\\\\]|\\\\.)*\"|(\\{)pod=\"(?:[^\"\\\\]|\\\\.)*\",?", "$1") at _binop_stream`
+	expected := `{app="nginx"} _time:5m | stats by (_stream) count() as value` +
+		` | union ({app="api"} _time:5m | stats by (_stream) count() as value | format "<_stream>" as _binop_stream | ` + removePod +
+		` | join by (_binop_stream) ({app="nginx"} _time:5m | stats by (_stream) count() as value | format "<_stream>" as _binop_stream | ` + removePod +
+		` | stats by (_binop_stream) count() as _binop_matches) | filter _binop_matches:"" | delete _binop_matches, _binop_stream)`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricPlusVector(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum(rate({app="nginx"}[5m])) + vector(1)`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats count() as value | math (value / 300) as value | math (value + 1) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricAvgRateByLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg by (severity) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (_stream, severity) count() as value | math (value / 300) as value | stats by (severity) avg(value) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricMaxOverTimeFused(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`max by (host) (max_over_time({app="nginx"} | unwrap duration [5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (host) max(duration) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricMaxOverTimeWithGroupingNotFused(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`max by (a) (max_over_time({app="x"} | logfmt b, a, x | unwrap x [5m]) by (b))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="x"} _time:5m | unpack_logfmt fields (b, a, x) | stats by (b) max(x) as value | stats max(value) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricAvgOverRangeAggregationWithGrouping(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg(avg_over_time({app="x"} | logfmt b, a, x | unwrap x [5m]) by (b))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="x"} _time:5m | unpack_logfmt fields (b, a, x) | stats by (b) avg(x) as value | stats avg(value) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricCountSeries(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count(count_over_time({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (_stream) count() as value | stats count() as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricStddev(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`stddev by (severity) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (_stream, severity) count() as value | math (value / 300) as value | math (value * value) as _sq` +
+		` | stats by (severity) avg(value) as _avg, avg(_sq) as _avg_sq | math (max(0, _avg_sq - _avg * _avg) ^ 0.5) as value | delete _avg, _avg_sq`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricSortDesc(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sort_desc(sum by (severity) (rate({app="nginx"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (severity) count() as value | math (value / 300) as value | sort by (value desc)` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricSumWithout(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum without (pod) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | replace_regexp (",pod=\"(?:[^\"\\\\]|\\\\.)*\"|(\\{)pod=\"(?:[^\"\\\\]|\\\\.)*\",?", "$1") at _stream` +
+		` | stats by (_stream) count() as value | math (value / 300) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 {
+		t.Fatalf("expected a warning about without() limits; got %q", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricAvgWithout(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg without (pod) (rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | stats by (_stream) count() as value | math (value / 300) as value` +
+		` | replace_regexp (",pod=\"(?:[^\"\\\\]|\\\\.)*\"|(\\{)pod=\"(?:[^\"\\\\]|\\\\.)*\",?", "$1") at _stream` +
+		` | stats by (_stream) avg(value) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricTopKByLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`topk by (service) (5, sum by (service, path) (rate({app="nginx"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (service, path) count() as value | math (value / 300) as value | first 5 (value desc) partition by (service)` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricTopKByLabelOverRangeAggregation(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`topk by (app) (3, rate({app=~"x|y"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app=~"x|y"} _time:5m | stats by (_stream, app) count() as value | math (value / 300) as value | first 3 (value desc) partition by (app)` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricTopKOverRangeAggregationWithGrouping(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`topk by (a) (1, max_over_time({app="x"} | logfmt b, a, x | unwrap x [5m]) by (b))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="x"} _time:5m | unpack_logfmt fields (b, a, x) | stats by (b) max(x) as value | first 1 (value desc)` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricTopKByMissingLabel(t *testing.T) {
+	tr, err := NewTranslator(Options{StreamFields: []string{"host"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	if _, err := tr.Translate(`topk by (app) (3, sort(rate({app=~"x|y"}[5m])))`); err == nil {
+		t.Fatalf("expected error for topk by the label missing in the inner series")
+	}
+}
+
+func TestTranslateMetricBottomKWithout(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`bottomk without (path) (3, sum by (service, path) (rate({app="nginx"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (service, path) count() as value | math (value / 300) as value | first 3 (value) partition by (service)` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricNestedVectorAggregation(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`max by (cluster) (sum by (cluster, pod) (rate({app="nginx"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (cluster, pod) count() as value | math (value / 300) as value | stats by (cluster) max(value) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricNestedCountAggregation(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg(count by (level) (count_over_time({app="nginx"} | json [5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_json keep_original_fields | stats by (_stream, level) count() as value` +
+		` | stats by (level) count() as value | stats avg(value) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricNestedAggregationByStreamLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (topk(3, rate({app=~"x|y"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{app=~"x|y"} _time:5m | stats by (_stream) count() as value | math (value / 300) as value | first 3 (value desc)` +
+		` | extract_regexp "[{,]app=\"(?P<app>(?:[^\"\\\\]|\\\\.)*)\"" from _stream | stats by (app) sum(value) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricNestedAggregationByMappedStreamLabel(t *testing.T) {
+	tr, err := NewTranslator(Options{LabelMapping: &LabelMapping{Preset: "vector"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`count by (container) (sort(rate({container=~"x|y"}[5m])))`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	expected := `{kubernetes.container_name=~"x|y"} _time:5m | stats by (_stream) count() as value | math (value / 300) as value | sort by (value)` +
+		` | extract_regexp "[{,]kubernetes\\.container_name=\"(?P<_stream_label>(?:[^\"\\\\]|\\\\.)*)\"" from _stream` +
+		` | rename _stream_label as kubernetes.container_name | stats by (kubernetes.container_name) count() as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricNestedAggregationOfConstant(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`count(vector(3))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindConstant {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.Value != 1 {
+		t.Fatalf("unexpected value: %v", qi.Value)
+	}
+}
+
+func TestTranslateMetricBytesRate(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (host) (bytes_rate({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | stats by (host) sum_len(_msg) as value | math (value / 300) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricBytesOverTime(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`bytes_over_time({app="nginx"}[1h])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:1h | stats by (_stream) sum_len(_msg) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricAbsentOverTime(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`absent_over_time({app="nginx"} |= "error" [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m "error" | stats count() as value | filter value:=0 | math 1 as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 {
+		t.Fatalf("unexpected warnings: %q", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricLastOverTime(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`last_over_time({app="nginx"} | logfmt | unwrap latency [5m]) by (host)`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | unpack_logfmt skip_empty_results | first 1 (_time desc) partition by (host) | stats by (host) max(latency) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricStddevOverTime(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`stddev_over_time({app="nginx"} | unwrap latency [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | math (latency * latency) as _sq` +
+		` | stats by (_stream) avg(latency) as _avg, avg(_sq) as _avg_sq` +
+		` | math (max(0, _avg_sq - _avg * _avg) ^ 0.5) as value | delete _avg, _avg_sq`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricStddevOverTimeConstantValues(t *testing.T) {
+	// avg(x^2) - avg(x)^2 is negative for three 0.1 values because of rounding errors, so its square root would be NaN.
+	values := []float64{0.1, 0.1, 0.1}
+	var sum, sumSq float64
+	for _, v := range values {
+		sum += v
+		sumSq += v * v
+	}
+	avg, avgSq := sum/float64(len(values)), sumSq/float64(len(values))
+	if avgSq-avg*avg >= 0 {
+		t.Fatalf("expected negative variance due to rounding errors; got %v", avgSq-avg*avg)
+	}
+	if stddev := math.Pow(max(0, avgSq-avg*avg), 0.5); stddev != 0 {
+		t.Fatalf("unexpected stddev of constant values: %v", stddev)
+	}
+
+	qi, err := TranslateLogQLToLogsQL(`stddev_over_time({app="nginx"} | unwrap latency [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if !strings.Contains(qi.LogsQL, ` | math (max(0, _avg_sq - _avg * _avg) ^ 0.5) as value`) {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricRateUnwrapUnsupported(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`rate({app="nginx"} | unwrap bytes_total [1m])`)
+	if err == nil {
+		t.Fatalf("expected error for rate with unwrap")
+	}
+	if !strings.Contains(err.Error(), "isn't supported yet") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTranslateMetricRateCounter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`rate_counter({app="nginx"} | unwrap bytes_total [1m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:1m | stats by (_stream) min(bytes_total) as _min, max(bytes_total) as _max` +
+		` | math ((_max - _min) / 60) as value | delete _min, _max`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 {
+		t.Fatalf("unexpected warnings: %q", qi.Warnings)
+	}
+}
+
+func TestTranslateMetricUnwrapDuration(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg_over_time({app="nginx"} | logfmt | unwrap duration(latency) [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_logfmt skip_empty_results | math (latency / 1000000000) as latency` +
+		` | stats by (_stream) avg(latency) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricUnwrapBytes(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum_over_time({app="nginx"} | json | unwrap bytes(size) [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} _time:5m | unpack_json keep_original_fields | math size as size | stats by (_stream) sum(size) as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslatePatternLineFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} |> "<_> GET /api/<_> 500 <_>"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindLogs {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	if qi.LogsQL != `{app="nginx"} ~`+quoteString(mustPatternLineFilterRegexp(t, "<_> GET /api/<_> 500 <_>")) {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestPatternLineFilterRegexpMatchesLoki(t *testing.T) {
+	f := func(match string, lines ...string) {
+		t.Helper()
+		m, err := pattern.ParseLineFilter([]byte(match))
+		if err != nil {
+			t.Fatalf("ParseLineFilter(%q) error: %v", match, err)
+		}
+		re := regexp.MustCompile(mustPatternLineFilterRegexp(t, match))
+		for _, line := range lines {
+			if want, got := m.Test([]byte(line)), re.MatchString(line); got != want {
+				t.Fatalf("unexpected match of %q against %q: got %v; want %v", line, match, got, want)
+			}
+		}
+	}
+	// Loki matches the first occurrence of every literal without backtracking.
+	f("<_> bar", "x bar", "x bar y bar", "bar", " bar", "x bar y")
+	f("<_> bar <_>", "x bar y", "x bar  bar y", " bar x bar y", "x bar ")
+	f("foo <_>", "foo x", "x foo y", "foo", "foofoo x", "foo foo x")
+	f("<_>aba<_>", "xabax", "xababax", "abax", "xaabax", "xaba")
+	f("ab<_>abab", "abxabab", "abxababab", "ababab", "abxabaabab")
+	f("<_> - - [<_>] \"<_>", `10.0.0.1 - - [16/Oct/2026] "GET /"`, `10.0.0.1 - - [a] - - [b] "GET /"`, `x - - [] "GET"`)
+	f("<_>", "", "x")
+	f("", "", "x")
+}
+
+func mustPatternLineFilterRegexp(t *testing.T, match string) string {
+	t.Helper()
+	re, err := patternLineFilterRegexp(match)
+	if err != nil {
+		t.Fatalf("patternLineFilterRegexp(%q) error: %v", match, err)
+	}
+	return re
+}
+
+func TestTranslateNotPatternLineFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} !> "<_> status=200"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} NOT ~`+quoteString(mustPatternLineFilterRegexp(t, "<_> status=200")) {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslatePatternLineFilterOr(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} |> "<_> level=error <_>" or "<_> level=warn <_>"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	want := `{app="nginx"} (~` + quoteString(mustPatternLineFilterRegexp(t, "<_> level=error <_>")) +
+		` OR ~` + quoteString(mustPatternLineFilterRegexp(t, "<_> level=warn <_>")) + `)`
+	if qi.LogsQL != want {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateNegativeLineFilterOr(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} != "debug" or "trace" |= "error"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} -"debug" -"trace" "error"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateNegativeRegexpLineFilterOr(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} !~ "x+" or "y+" or "z+"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} NOT ~"x+" NOT ~"y+" NOT ~"z+"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateNegativeLineFilterOrGroup(t *testing.T) {
+	e := &syntax.LineFilterExpr{
+		LineFilter: syntax.LineFilter{Ty: lokilog.LineMatchNotEqual, Match: "a"},
+		Or: &syntax.LineFilterExpr{
+			LineFilter: syntax.LineFilter{Ty: lokilog.LineMatchNotEqual, Match: "b"},
+			IsOrChild:  true,
+		},
+	}
+	s, err := defaultTranslator.translateLineFilterOrGroup(e)
+	if err != nil {
+		t.Fatalf("translateLineFilterOrGroup error: %v", err)
+	}
+	if s != `NOT ("a" OR "b")` {
+		t.Fatalf("unexpected LogsQL: %q", s)
+	}
+}
+
+func TestTranslateIPLineFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="fw"} |= ip("192.168.0.1-192.168.0.3")`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="fw"} ~"(?:^|[^0-9.])(?:192\\.168\\.0\\.1|192\\.168\\.0\\.[2-3])(?:$|[^0-9.])"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateNotIPLineFilter(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="fw"} != ip("10.1.2.3")`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="fw"} NOT ~"(?:^|[^0-9.])10\\.1\\.2\\.3(?:$|[^0-9.])"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestIPLineFilterRegexpCIDR(t *testing.T) {
+	s, err := ipLineFilterRegexp("172.16.0.0/12")
+	if err != nil {
+		t.Fatalf("ipLineFilterRegexp error: %v", err)
+	}
+	re := regexp.MustCompile(s)
+	for line, expected := range map[string]bool{
+		"accept src=172.16.0.1 dst=8.8.8.8": true,
+		"accept src=172.31.255.255:443":     true,
+		"172.20.1.1":                        true,
+		"accept src=172.32.0.1":             false,
+		"accept src=172.15.255.255":         false,
+		"accept src=1172.16.0.1":            false,
+		"accept src=172.16.0.1.5":           false,
+		"accept src=172.16.0.256":           false,
+	} {
+		if re.MatchString(line) != expected {
+			t.Fatalf("unexpected match result for %q; expected %v", line, expected)
+		}
+	}
+}
+
+func TestIPLineFilterIPv6Unsupported(t *testing.T) {
+	if _, err := TranslateLogQLToLogsQL(`{app="fw"} |= ip("::1")`); err == nil {
+		t.Fatalf("expected error for IPv6 ip() line filter")
+	}
+}
+
+func TestTranslateJSONExpressionParserQuotedKey(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="audit"} | json ua="request.headers[\"User-Agent\"]"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="audit"} | unpack_json fields ("request.headers.User-Agent")` +
+		` | format "<request.headers.User-Agent>" as ua | delete "request.headers.User-Agent"`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONExpressionParserArrayIndex(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="audit"} | json first_server="servers[0]"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="audit"} | unpack_json fields (servers)` +
+		` | extract_regexp ` + quoteString(jsonArrayElementRegexp(0, "_json_0_0")) + ` from servers` +
+		` | replace_regexp ("^\"(.*)\"$", "$1") at _json_0_0` +
+		` | format "<_json_0_0>" as first_server | delete servers, _json_0_0`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONExpressionParserArrayObject(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="audit"} | json name="items[1].metadata.name"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="audit"} | unpack_json fields (items)` +
+		` | extract_regexp ` + quoteString(jsonArrayElementRegexp(1, "_json_0_0")) + ` from items` +
+		` | unpack_json from _json_0_0 fields (metadata.name) result_prefix "_json_0_0."` +
+		` | format "<_json_0_0.metadata.name>" as name | delete items, _json_0_0, _json_0_0.metadata.name`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONExpressionNestedArrayIndex(t *testing.T) {
+	for _, expr := range []string{`matrix[0][1]`, `items[0].ports[1]`} {
+		_, err := TranslateLogQLToLogsQL(`{app="audit"} | json v="` + expr + `"`)
+		if err == nil {
+			t.Fatalf("expected error for %s", expr)
+		}
+		if !strings.Contains(err.Error(), "nested arrays") {
+			t.Fatalf("unexpected error for %s: %v", expr, err)
+		}
+	}
+}
+
+func TestJSONArrayElementRegexp(t *testing.T) {
+	re := regexp.MustCompile(jsonArrayElementRegexp(2, "elem"))
+	m := re.FindStringSubmatch(`[ "a,\"b", {"k":"v,1"}, [1,"]"], 3]`)
+	if len(m) != 2 || m[1] != `[1,"]"]` {
+		t.Fatalf("unexpected match: %q", m)
+	}
+}
+
+func TestTranslateLineFormatSimple(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | line_format "{{.method}} {{ .path }}"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} | format "<method> <path>"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFormatEscapesLiteralText(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | line_format `<{{.a}}> & {{ printf \"<%s>\" .b }} {{ .c | default \"<none>\" }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format "<c>" as _tmpl_0 | format if (_tmpl_0:="") "&lt;none&gt;" as _tmpl_0` +
+		` | format "&lt;<a>&gt; &amp; &lt;<b>&gt; <_tmpl_0>" | delete _tmpl_0`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFormatFunctions(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | line_format "{{ .method | ToUpper }} {{ printf \"%q\" .path }}"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} | format "<uc:method> <q:path>"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFormatIfElse(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | line_format `{{ if eq .level \"error\" }}E: {{ .msg }}{{ else }}{{ __line__ }}{{ end }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format if (level:=error) "E: <msg>" as _tmpl_0` +
+		` | format if (NOT level:=error) "<_msg>" as _tmpl_0 | format "<_tmpl_0>" | delete _tmpl_0`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFormatRegexReplace(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | line_format `{{ regexReplaceAll \"id=(\\\\d+)\" .msg \"id=<$1>\" | trunc 10 }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format "<msg>" as _tmpl_0 | replace_regexp ("id=(\\d+)", "id=<$1>") at _tmpl_0` +
+		` | replace_regexp ("(?s)^(.{10}).*", "$1") at _tmpl_0 | format "<_tmpl_0>" | delete _tmpl_0`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLabelFormatDefaultAndMath(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | label_format user=`{{ .user | default \"anonymous\" }}`, next=`{{ add .retry 1 }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format "<user>" as _tmpl_0 | format if (_tmpl_0:="") "anonymous" as _tmpl_0` +
+		` | format "<_tmpl_0>" as user | delete _tmpl_0` +
+		` | format "0" as _tmpl_0 | format if (retry:~"^[-+]?[0-9]+(?:\\.0+)?$") "<retry>" as _tmpl_0` +
+		` | math (_tmpl_0 + 1) as _tmpl_1 | format "<_tmpl_1>" as next | delete _tmpl_0, _tmpl_1`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLabelFormatSwap(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | label_format a=`{{ .b }}`, b=`{{ .a }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format "<b>" as _label_fmt_0 | format "<a>" as _label_fmt_1 | rename _label_fmt_0 as a, _label_fmt_1 as b`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLabelFormatRenameOrder(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | label_format c=a, d=`{{ .c }}`, e=b, f=`{{ .e }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | rename a as c | format "<c>" as d | format "<e>" as _label_fmt_0 | rename b as e, _label_fmt_0 as f`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLabelFormatIntegerMath(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL("{app=\"nginx\"} | label_format q=`{{ div .total 2.5 }}`, f=`{{ divf .total 2.5 }}`")
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | format "0" as _tmpl_0 | format if (total:~"^[-+]?[0-9]+(?:\\.0+)?$") "<total>" as _tmpl_0` +
+		` | math ((_tmpl_0 - _tmpl_0 % 2) / 2) as _tmpl_1 | format "<_tmpl_1>" as q | delete _tmpl_0, _tmpl_1` +
+		` | math (total / 2.5) as _tmpl_0 | format "<_tmpl_0>" as f | delete _tmpl_0`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFormatUnsupportedFunction(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`{app="nginx"} | line_format "{{ __timestamp__ | date \"2006-01-02\" }}"`)
+	if err == nil {
+		t.Fatalf("expected error for unsupported template function")
+	}
+	if !strings.Contains(err.Error(), `"date"`) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTranslateLineFormatPrintfNumbers(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | line_format "{{ printf \"%.2f ms, %d retries\" .latency .retries }}"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | math round(latency, 0.01) as _tmpl_0 | math round(retries) as _tmpl_1` +
+		` | format "<_tmpl_0> ms, <_tmpl_1> retries" | delete _tmpl_0, _tmpl_1`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if len(qi.Warnings) != 1 || !strings.Contains(qi.Warnings[0], "%.2f") {
+		t.Fatalf("unexpected warnings: %q", qi.Warnings)
+	}
+}
+
+func TestTranslateLineFormatUnsupportedPrintfVerb(t *testing.T) {
+	_, err := TranslateLogQLToLogsQL(`{app="nginx"} | line_format "{{ printf \"%08x\" .id }}"`)
+	if err == nil {
+		t.Fatalf("expected error for unsupported printf verb")
+	}
+	if !strings.Contains(err.Error(), "%08x") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTranslateMetricLabelReplace(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (label_replace(sum by (pod) (rate({ns="prod"}[5m])), "app", "$1", "pod", "(.*)-[a-z0-9]+"))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.Kind != QueryKindStats {
+		t.Fatalf("unexpected kind: %q", qi.Kind)
+	}
+	expected := `{ns="prod"} _time:5m | stats by (pod) count() as value | math (value / 300) as value` +
+		` | format "<pod>" as _label_replace | replace_regexp ("^(?:(.*)-[a-z0-9]+)$", "$1") at _label_replace` +
+		` | format if (pod:~"^(?:(.*)-[a-z0-9]+)$") "<_label_replace>" as app | delete _label_replace` +
+		` | stats by (app) sum(value) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricLabelReplaceStreamLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`label_replace(rate({ns="prod"}[5m]), "app", "$1", "pod", "(.*)")`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{ns="prod"} _time:5m | stats by (_stream) count() as value | math (value / 300) as value` +
+		` | extract_regexp "[{,]pod=\"(?P<pod>(?:[^\"\\\\]|\\\\.)*)\"" from _stream` +
+		` | format "<pod>" as _label_replace | replace_regexp ("^(?:(.*))$", "$1") at _label_replace` +
+		` | format if (pod:~"^(?:(.*))$") "<_label_replace>" as app | delete _label_replace | delete pod`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricLabelReplaceNonStreamLabel(t *testing.T) {
+	tr, err := NewTranslator(Options{StreamFields: []string{"ns"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	if _, err := tr.Translate(`label_replace(rate({ns="prod"}[5m]), "app", "$1", "pod", "(.*)")`); err == nil {
+		t.Fatalf("expected error for label_replace() over the label missing in the series")
+	}
+}
+
+func TestTranslateWithLabelMapping(t *testing.T) {
+	tr, err := NewTranslator(Options{LabelMapping: &LabelMapping{
+		Exact: map[string]string{"namespace": "kubernetes.pod_namespace", "pod": "kubernetes.pod_name"},
+		Regex: []LabelMappingRule{{Match: `label_(.+)`, Replacement: "kubernetes.pod_labels.$1"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`{namespace="prod", label_app=~"api.*"} | pod!="x" | line_format "{{ .pod }}: {{ .msg }}"`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	expected := `{kubernetes.pod_namespace="prod",kubernetes.pod_labels.app=~"api.*"} -kubernetes.pod_name:=x | format "<kubernetes.pod_name>: <msg>"`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricWithLabelMapping(t *testing.T) {
+	tr, err := NewTranslator(Options{LabelMapping: &LabelMapping{Exact: map[string]string{"pod": "kubernetes.pod_name", "latency": "duration"}}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`sum by (pod) (sum_over_time({app="nginx"} | logfmt | unwrap latency [5m]))`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	expected := `{app="nginx"} _time:5m | unpack_logfmt skip_empty_results` +
+		` | format if (duration:"") "<latency>" as duration | format if (kubernetes.pod_name:"") "<pod>" as kubernetes.pod_name` +
+		` | stats by (kubernetes.pod_name) sum(duration) as value`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateJSONWithLabelMapping(t *testing.T) {
+	tr, err := NewTranslator(Options{LabelMapping: &LabelMapping{Preset: "vector"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`{app="nginx"} | json | container="x" | pod_extracted="y" | node_name="z"`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	// Mapped labels are restored from the JSON keys named after LogQL labels, unless the log stream has them.
+	expected := `{app="nginx"} | unpack_json fields (pod) result_prefix "_json_extracted."` +
+		` | format if (kubernetes.pod_name:*) "<_json_extracted.pod>" as pod_extracted | delete _json_extracted.pod` +
+		` | unpack_json keep_original_fields` +
+		` | format if (kubernetes.container_name:"") "<container>" as kubernetes.container_name` +
+		` | format if (kubernetes.pod_node_name:"") "<node.name><node-name><node_name>" as kubernetes.pod_node_name` +
+		` | filter kubernetes.container_name:=x | filter pod_extracted:=y | filter kubernetes.pod_node_name:=z`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateWithLabelMappingPreset(t *testing.T) {
+	tr, err := NewTranslator(Options{LabelMapping: &LabelMapping{Preset: "opentelemetry"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`{service_name="api", k8s_namespace_name="prod"}`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	if qi.LogsQL != `{service.name="api",k8s.namespace.name="prod"}` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestNewTranslatorInvalidLabelMapping(t *testing.T) {
+	if _, err := NewTranslator(Options{LabelMapping: &LabelMapping{Preset: "unknown"}}); err == nil {
+		t.Fatalf("expected error for unknown label mapping preset")
+	}
+	if _, err := NewTranslator(Options{LabelMapping: &LabelMapping{Regex: []LabelMappingRule{{Match: "("}}}}); err == nil {
+		t.Fatalf("expected error for invalid label mapping regex")
+	}
+}
+
+func TestTranslateWithStreamFields(t *testing.T) {
+	tr, err := NewTranslator(Options{StreamFields: []string{"app"}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`{app="nginx", namespace=~"prod|dev", pod!="x"} |= "error"`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} namespace:in(prod, dev) -pod:=x "error"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricWithoutStreamFields(t *testing.T) {
+	tr, err := NewTranslator(Options{StreamFields: []string{}})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`sum by (level) (count_over_time({namespace="prod"}[5m]))`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	if qi.LogsQL != `namespace:=prod _time:5m | stats by (level) count() as value` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateRegexpLabelFilterAnchored(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | path=~"/api/v[0-9]+" | user!~"(?i)admin" |~ "err(or)?"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | unpack_json keep_original_fields | filter path:~"^(?s:/api/v[0-9]+)$" | filter -user:~"^(?s:(?i)admin)$" | filter ~"err(or)?"`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateRegexpLabelFilterSimplified(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | logfmt | method=~"GET|POST" | path=~"/api/.*" | user=~".+" | level!~""`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | unpack_logfmt skip_empty_results | filter method:in(GET, POST) | filter path:=/api/* | filter user:* | filter -level:=""`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFilterSubstringMode(t *testing.T) {
+	tr, err := NewTranslator(Options{LineFilterMode: LineFilterModeSubstring})
+	if err != nil {
+		t.Fatalf("NewTranslator error: %v", err)
+	}
+	qi, err := tr.Translate(`{app="nginx"} |= "err" != "file.log" |= "" |~ "5.."`)
+	if err != nil {
+		t.Fatalf("Translate error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} *err* NOT ~"file\\.log" ~"5.."` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateLineFilterEmpty(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} |= "" |= "error"`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	if qi.LogsQL != `{app="nginx"} "error"` {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestNewTranslatorInvalidLineFilterMode(t *testing.T) {
+	if _, err := NewTranslator(Options{LineFilterMode: "regexp"}); err == nil {
+		t.Fatalf("expected error for unknown line filter mode")
+	}
+}
+
+func TestTranslateMetricLogsQLAt(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum(count_over_time({app="nginx"}[5m])) / sum(count_over_time({app="nginx"}[1h] offset 1d))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	logsQL, err := qi.LogsQLAt(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("LogsQLAt error: %v", err)
+	}
+	if strings.Contains(qi.LogsQL, "2024") || !strings.Contains(qi.LogsQL, "_time:1h offset 1d") {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+	if !strings.Contains(logsQL, `{app="nginx"} _time:(2024-01-02T02:59:05Z, 2024-01-02T03:04:05Z] | stats count() as value`) {
+		t.Fatalf("unexpected LogsQL at 2024-01-02T03:04:05Z: %q", logsQL)
+	}
+	if !strings.Contains(logsQL, `{app="nginx"} _time:(2024-01-01T02:04:05Z, 2024-01-01T03:04:05Z] | stats count() as value`) {
+		t.Fatalf("unexpected LogsQL at 2024-01-02T03:04:05Z: %q", logsQL)
+	}
+}
+
+func TestTranslateMetricLogsQLAtMergedStats(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`sum by (app) (count_over_time({app="nginx"} |= "error" [5m])) / sum by (app) (count_over_time({app="nginx"}[5m]))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	logsQL, err := qi.LogsQLAt(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("LogsQLAt error: %v", err)
+	}
+	expected := `{app="nginx"} _time:(2024-01-02T02:59:05Z, 2024-01-02T03:04:05Z] | stats by (app) count() if ("error") as lhs, count() as rhs | filter lhs:>0 rhs:>0 | math (lhs / rhs) as value | delete lhs, rhs`
+	if logsQL != expected {
+		t.Fatalf("unexpected LogsQL at 2024-01-02T03:04:05Z: %q", logsQL)
+	}
+}
+
+func TestTranslateJSONKeepReferencedLabel(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`{app="nginx"} | json | keep req_method`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	expected := `{app="nginx"} | unpack_json keep_original_fields | format if (req_method:"") "<req.method><req-method>" as req_method | keep _time, _msg, req_method`
+	if qi.LogsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", qi.LogsQL)
+	}
+}
+
+func TestTranslateMetricLogsQLRange(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`topk(2, sum by (level) (count_over_time({app="nginx"}[5m])))`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	start := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	points := []time.Time{start, start.Add(time.Minute), start.Add(2 * time.Minute)}
+	logsQL, err := qi.LogsQLRange(points, time.Minute)
+	if err != nil {
+		t.Fatalf("LogsQLRange error: %v", err)
+	}
+	// Windows of adjacent points overlap, so every minute bucket is assigned to all the points, which windows contain it.
+	expected := `{app="nginx"} _time:(2024-01-02T02:59:00Z, 2024-01-02T03:06:00Z] | stats by (_time:1m offset 1ns, level) count() as value` +
+		` | math abs(round((_time - 1704164340000000001) / 60000000000)) as _bucket | format "[0,1,2]" as _shift | unroll by (_shift)` +
+		` | math (max(0, _bucket - 4) + _shift) as _point | math (_bucket - _point) as _bucket | filter _point:<=2 _bucket:>=0` +
+		` | stats by (_point, level) sum(value) as value | first 2 (value desc) partition by (_point)`
+	if logsQL != expected {
+		t.Fatalf("unexpected LogsQL: %q", logsQL)
+	}
+}
+
+func TestTranslateMetricLogsQLRangeUnsupported(t *testing.T) {
+	qi, err := TranslateLogQLToLogsQL(`avg_over_time({app="nginx"} | unwrap latency [5m])`)
+	if err != nil {
+		t.Fatalf("TranslateLogQLToLogsQL error: %v", err)
+	}
+	start := time.Date(2024, 1, 2, 3, 4, 0, 0, time.UTC)
+	if _, err := qi.LogsQLRange([]time.Time{start, start.Add(5 * time.Minute)}, 5*time.Minute); err != nil {
+		t.Fatalf("LogsQLRange error: %v", err)
+	}
+	_, err = qi.LogsQLRange([]time.Time{start, start.Add(time.Minute)}, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "avg_over_time cannot be merged over `_time` buckets, so the step 1m must be a multiple of the range [5m], e.g. 5m") {
+		t.Fatalf("expected avg_over_time error, got: %v", err)
+	}
+}
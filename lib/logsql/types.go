@@ -1,13 +1,43 @@
 package logsql
 
+import "time"
+
 type QueryKind string
 
 const (
 	QueryKindLogs  QueryKind = "logs"
 	QueryKindStats QueryKind = "stats"
+	// QueryKindConstant is a metric query, which result doesn't depend on logs, e.g. `vector(1)`.
+	// LogsQL contains an equivalent query returning a single row, while Value holds the constant itself.
+	QueryKindConstant QueryKind = "constant"
 )
 
 type QueryInfo struct {
 	Kind   QueryKind
 	LogsQL string
+	Value  float64
+	// Warnings describe the known differences between the LogQL query and its translation.
+	Warnings []string
+
+	// logsQLAt returns LogsQL for stats queries evaluated at the given time.
+	logsQLAt func(t time.Time) (string, error)
+	// logsQLRange returns LogsQL for stats queries evaluated at the given points by a single query. See LogsQLRange.
+	logsQLRange func(points []time.Time, step time.Duration) (string, error)
+}
+
+// LogsQLAt returns LogsQL for the stats query evaluated at the time t the same way as Loki evaluates metric queries:
+// every range aggregation selects logs in the (t-range-offset, t-offset] window.
+func (qi *QueryInfo) LogsQLAt(t time.Time) (string, error) {
+	if qi.logsQLAt == nil {
+		return qi.LogsQL, nil
+	}
+	return qi.logsQLAt(t)
+}
+
+// LogsQLRange returns LogsQL evaluating the stats query at the given points, which are step apart, by a single query.
+func (qi *QueryInfo) LogsQLRange(points []time.Time, step time.Duration) (string, error) {
+	if qi.logsQLRange == nil || len(points) == 0 {
+		return "", newBadRequest("only stats queries can be evaluated at the points of a range query", nil)
+	}
+	return qi.logsQLRange(points, step)
 }
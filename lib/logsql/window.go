@@ -0,0 +1,69 @@
+package logsql
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// windowPlaceholderSep delimits placeholders of range aggregation windows in the translated LogsQL.
+const windowPlaceholderSep = "\x00"
+
+// timeWindows collects the windows selected by range aggregations of a metric query.
+type timeWindows struct {
+	windows []timeWindow
+}
+
+// timeWindow is the window of a range aggregation: (t-interval-offset, t-offset] for the evaluation time t.
+type timeWindow struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+// placeholder returns the placeholder for the time filter of r. Equal windows have equal placeholders.
+func (tw *timeWindows) placeholder(r *syntax.LogRangeExpr) string {
+	w := timeWindow{interval: r.Interval, offset: r.Offset}
+	i := slices.Index(tw.windows, w)
+	if i < 0 {
+		i = len(tw.windows)
+		tw.windows = append(tw.windows, w)
+	}
+	return windowPlaceholderSep + strconv.Itoa(i) + windowPlaceholderSep
+}
+
+// render returns s with the placeholders replaced by the windows ending at t, or by relative windows if t is zero.
+func (tw *timeWindows) render(s string, t time.Time) string {
+	if len(tw.windows) == 0 {
+		return s
+	}
+	parts := strings.Split(s, windowPlaceholderSep)
+	var sb strings.Builder
+	for i, part := range parts {
+		if i%2 == 0 {
+			sb.WriteString(part)
+			continue
+		}
+		n, _ := strconv.Atoi(part)
+		sb.WriteString(tw.windows[n].filter(t))
+	}
+	return sb.String()
+}
+
+// filter returns the filter selecting logs in the window ending at t, or the relative filter such as `_time:5m offset 1m` if t is zero.
+func (w timeWindow) filter(t time.Time) string {
+	if !t.IsZero() {
+		end := t.Add(-w.offset)
+		start := end.Add(-w.interval)
+		return fmt.Sprintf("_time:(%s, %s]", formatTime(start), formatTime(end))
+	}
+	filter := "_time:" + prommodel.Duration(w.interval).String()
+	if w.offset != 0 {
+		filter += " offset " + prommodel.Duration(w.offset).String()
+	}
+	return filter
+}
@@ -19,15 +19,20 @@ type EndpointConfig struct {
 
 type RequestParams struct {
 	EndpointConfig
-	Start    string
-	End      string
+	Start string
+	End   string
+	// Step is the step of range stats queries: a duration such as 30s or a number of seconds.
+	Step     string
 	ExecMode string
 }
 
 type API struct {
-	ec     EndpointConfig
-	limit  uint32
-	client *http.Client
+	ec           EndpointConfig
+	limit        uint32
+	client       *http.Client
+	streamFields streamFieldsCache
+
+	perPointEvaluation bool
 }
 
 func NewVLogsAPI(ec EndpointConfig, limit uint32) *API {
@@ -44,18 +49,33 @@ func (a *API) SetHTTPClient(client *http.Client) {
 	a.client = client
 }
 
-func (a *API) Execute(ctx context.Context, qi *logsql.QueryInfo, params RequestParams) ([]byte, error) {
-	if a.ec.Endpoint != "" && params.Endpoint != "" && a.ec.Endpoint != params.Endpoint {
-		return nil, &APIError{
+// SetPerPointEvaluation enables evaluating range stats queries, which cannot be evaluated by a single query, by an instant query per point.
+func (a *API) SetPerPointEvaluation(enabled bool) {
+	a.perPointEvaluation = enabled
+}
+
+// resolveEndpoint returns the endpoint config for the request: either the configured one or the one from the request.
+func (a *API) resolveEndpoint(ec EndpointConfig) (EndpointConfig, error) {
+	if a.ec.Endpoint != "" && ec.Endpoint != "" && a.ec.Endpoint != ec.Endpoint {
+		return EndpointConfig{}, &APIError{
 			Code:    http.StatusBadRequest,
 			Message: "endpoint can be set either in config or in request, not both",
 		}
 	}
-	recParams := params
-	if recParams.Endpoint == "" {
-		recParams.Endpoint = a.ec.Endpoint
-		recParams.BearerToken = a.ec.BearerToken
+	if ec.Endpoint == "" {
+		return a.ec, nil
 	}
+	return ec, nil
+}
+
+// Execute runs the translated query at the VictoriaLogs endpoint. It returns nil in the translate mode.
+func (a *API) Execute(ctx context.Context, qi *logsql.QueryInfo, params RequestParams) ([]byte, error) {
+	ec, err := a.resolveEndpoint(params.EndpointConfig)
+	if err != nil {
+		return nil, err
+	}
+	recParams := params
+	recParams.EndpointConfig = ec
 
 	if recParams.Endpoint == "" || strings.EqualFold(recParams.ExecMode, "translate") {
 		return nil, nil
@@ -65,10 +85,12 @@ func (a *API) Execute(ctx context.Context, qi *logsql.QueryInfo, params RequestP
 	case logsql.QueryKindLogs:
 		return a.QueryLogs(ctx, qi.LogsQL, recParams)
 	case logsql.QueryKindStats:
-		if strings.TrimSpace(recParams.Start) == "" && strings.TrimSpace(recParams.End) == "" {
-			return a.QueryStats(ctx, qi.LogsQL, recParams)
+		if isInstantQuery(recParams) {
+			return a.evalStats(ctx, qi, recParams)
 		}
-		return a.QueryStatsRange(ctx, qi.LogsQL, recParams)
+		return a.evalStatsRange(ctx, qi, recParams)
+	case logsql.QueryKindConstant:
+		return constantStats(qi.Value, recParams)
 	default:
 		return nil, &APIError{
 			Code:    http.StatusBadRequest,
@@ -90,6 +112,7 @@ func (a *API) QueryLogs(ctx context.Context, logsQL string, params RequestParams
 	return a.doForm(ctx, params, "/select/logsql/query", form)
 }
 
+// QueryStats runs the LogsQL stats query at params.End or at the current time if it isn't set.
 func (a *API) QueryStats(ctx context.Context, logsQL string, params RequestParams) ([]byte, error) {
 	form := url.Values{}
 	form.Set("query", logsQL)
@@ -99,6 +122,7 @@ func (a *API) QueryStats(ctx context.Context, logsQL string, params RequestParam
 	return a.doForm(ctx, params, "/select/logsql/stats_query", form)
 }
 
+// QueryStatsRange runs the LogsQL stats query over non-overlapping step buckets of the time range.
 func (a *API) QueryStatsRange(ctx context.Context, logsQL string, params RequestParams) ([]byte, error) {
 	form := url.Values{}
 	form.Set("query", logsQL)
@@ -108,10 +132,34 @@ func (a *API) QueryStatsRange(ctx context.Context, logsQL string, params Request
 	if params.End != "" {
 		form.Set("end", params.End)
 	}
-	form.Set("step", "1h")
+	step := params.Step
+	if step == "" {
+		step = "1h"
+	}
+	form.Set("step", step)
 	return a.doForm(ctx, params, "/select/logsql/stats_query_range", form)
 }
 
+// evalStats evaluates the translated stats query at params.End or at the current time if it isn't set.
+func (a *API) evalStats(ctx context.Context, qi *logsql.QueryInfo, params RequestParams) ([]byte, error) {
+	t, err := parseTime(params.End, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logsQL, err := qi.LogsQLAt(t)
+	if err != nil {
+		return nil, err
+	}
+	return a.queryStats(ctx, logsQL, t, params)
+}
+
+func (a *API) queryStats(ctx context.Context, logsQL string, t time.Time, params RequestParams) ([]byte, error) {
+	form := url.Values{}
+	form.Set("query", logsQL)
+	form.Set("time", t.UTC().Format(time.RFC3339Nano))
+	return a.doForm(ctx, params, "/select/logsql/stats_query", form)
+}
+
 func (a *API) doForm(ctx context.Context, params RequestParams, path string, form url.Values) ([]byte, error) {
 	if params.Endpoint == "" {
 		return nil, &APIError{
@@ -0,0 +1,403 @@
+package vlogs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics-Community/logql-to-logsql/lib/logsql"
+	prommodel "github.com/prometheus/common/model"
+)
+
+// statsResponse is the Prometheus-compatible response returned by VictoriaLogs stats endpoints.
+type statsResponse struct {
+	Status string    `json:"status"`
+	Data   statsData `json:"data"`
+}
+
+type statsData struct {
+	ResultType string        `json:"resultType"`
+	Result     []statsSeries `json:"result"`
+}
+
+type statsSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []any             `json:"value,omitempty"`
+	Values [][]any           `json:"values,omitempty"`
+}
+
+// constantStats returns a stats response for a query with the constant result in the same format as VictoriaLogs does.
+func constantStats(v float64, params RequestParams) ([]byte, error) {
+	metric := map[string]string{"__name__": "value"}
+	resp := statsResponse{Status: "success"}
+	if isInstantQuery(params) {
+		t, err := parseTime(params.End, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		resp.Data = statsData{
+			ResultType: "vector",
+			Result: []statsSeries{{
+				Metric: metric,
+				Value:  statsSample(t, v),
+			}},
+		}
+		return json.Marshal(resp)
+	}
+
+	r, err := parseRange(params)
+	if err != nil {
+		return nil, err
+	}
+	var values [][]any
+	for _, t := range r.points() {
+		values = append(values, statsSample(t, v))
+	}
+	resp.Data = statsData{
+		ResultType: "matrix",
+		Result: []statsSeries{{
+			Metric: metric,
+			Values: values,
+		}},
+	}
+	return json.Marshal(resp)
+}
+
+// isInstantQuery returns true if the stats query must be evaluated at the end time (or the current time) instead of the time range.
+func isInstantQuery(params RequestParams) bool {
+	start := strings.TrimSpace(params.Start)
+	return start == "" || start == strings.TrimSpace(params.End)
+}
+
+// maxRangePoints is the maximum number of points returned per series by range queries. It is the same as in Loki.
+const maxRangePoints = 11000
+
+// queryRange is the time range of a range query.
+type queryRange struct {
+	start time.Time
+	end   time.Time
+	step  time.Duration
+}
+
+// parseRange parses the time range of a range query with the same defaults as in Loki.
+func parseRange(params RequestParams) (*queryRange, error) {
+	end, err := parseTime(params.End, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTime(params.Start, end.Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if end.Before(start) {
+		return nil, &APIError{
+			Code:    http.StatusBadRequest,
+			Message: "end must not be before start",
+		}
+	}
+	step, err := parseStep(params.Step)
+	if err != nil {
+		return nil, err
+	}
+	if step == 0 {
+		step = max(time.Duration(math.Floor(end.Sub(start).Seconds()/250))*time.Second, time.Second)
+	}
+	if end.Sub(start)/step >= maxRangePoints {
+		return nil, &APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("exceeded maximum resolution of %d points per series; increase step", maxRangePoints),
+		}
+	}
+	return &queryRange{start: start, end: end, step: step}, nil
+}
+
+// points returns the evaluation times of the range query.
+func (r *queryRange) points() []time.Time {
+	var ts []time.Time
+	for t := r.start; !t.After(r.end); t = t.Add(r.step) {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// parseStep parses the step of a range query: a duration such as 30s or a number of seconds. It returns zero for an empty step.
+func parseStep(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f <= 0 {
+			return 0, &APIError{Code: http.StatusBadRequest, Message: fmt.Sprintf("step must be positive; got %q", s)}
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := prommodel.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, &APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("cannot parse step %q", s),
+			Err:     err,
+		}
+	}
+	return time.Duration(d), nil
+}
+
+// statsRangeConcurrency is the maximum number of concurrent instant queries evaluating a range query per point.
+const statsRangeConcurrency = 8
+
+// maxPerPointRangePoints is the maximum number of points of range queries evaluated by an instant query per point.
+const maxPerPointRangePoints = 300
+
+// evalStatsRange evaluates the translated stats query at every step of the range over Loki sliding windows.
+func (a *API) evalStatsRange(ctx context.Context, qi *logsql.QueryInfo, params RequestParams) ([]byte, error) {
+	r, err := parseRange(params)
+	if err != nil {
+		return nil, err
+	}
+	points := r.points()
+	m := newMatrixBuilder()
+	logsQL, err := qi.LogsQLRange(points, r.step)
+	switch {
+	case err == nil:
+		err = a.queryStatsAllPoints(ctx, logsQL, points, params, m)
+	case errors.Is(err, logsql.ErrRangeQueryUnsupported) && a.perPointEvaluation:
+		err = a.queryStatsPerPoint(ctx, qi, points, params, m)
+	case errors.Is(err, logsql.ErrRangeQueryUnsupported):
+		var te *logsql.TranslationError
+		msg := err.Error()
+		if errors.As(err, &te) {
+			msg = te.Message
+		}
+		return nil, &APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("cannot evaluate the query over the time range by a single VictoriaLogs query: %s; per-point evaluation is disabled; enable it with the perPointEvaluation config option", msg),
+			Err:     err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m.response())
+}
+
+// queryStatsAllPoints adds the results of the single query evaluating the stats query at all the points to m.
+func (a *API) queryStatsAllPoints(ctx context.Context, logsQL string, points []time.Time, params RequestParams, m *matrixBuilder) error {
+	form := url.Values{}
+	form.Set("query", logsQL)
+	body, err := a.doForm(ctx, params, "/select/logsql/query", form)
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var row map[string]string
+		if err := json.Unmarshal(line, &row); err != nil {
+			return &APIError{
+				Code:    http.StatusBadGateway,
+				Message: "failed to parse stats query response",
+				Err:     err,
+			}
+		}
+		i, err := strconv.Atoi(row[logsql.RangePointField])
+		if err != nil || i < 0 || i >= len(points) {
+			return &APIError{
+				Code:    http.StatusBadGateway,
+				Message: fmt.Sprintf("unexpected point %q in stats query response", row[logsql.RangePointField]),
+				Err:     err,
+			}
+		}
+		metric := map[string]string{"__name__": "value"}
+		for name, value := range row {
+			if name != logsql.RangePointField && name != "value" && value != "" {
+				metric[name] = value
+			}
+		}
+		m.add(metric, points[i], row["value"])
+	}
+	return nil
+}
+
+// queryStatsPerPoint adds the results of the stats query evaluated by an instant query at every point to m.
+func (a *API) queryStatsPerPoint(ctx context.Context, qi *logsql.QueryInfo, points []time.Time, params RequestParams, m *matrixBuilder) error {
+	if len(points) > maxPerPointRangePoints {
+		return &APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("exceeded maximum resolution of %d points per series for the query evaluated by a query per point; increase step", maxPerPointRangePoints),
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The first error cancels the remaining queries.
+	var mu sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	results := make([]*statsResponse, len(points))
+	sem := make(chan struct{}, statsRangeConcurrency)
+	var wg sync.WaitGroup
+loop:
+	for i, t := range points {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			setErr(ctx.Err())
+			break loop
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp, err := a.queryStatsAt(ctx, qi, t, params)
+			if err != nil {
+				setErr(err)
+				return
+			}
+			results[i] = resp
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for i, t := range points {
+		for _, s := range results[i].Data.Result {
+			if len(s.Value) != 2 {
+				continue
+			}
+			m.add(s.Metric, t, s.Value[1])
+		}
+	}
+	return nil
+}
+
+// matrixBuilder collects samples of range query series.
+type matrixBuilder struct {
+	series map[string]*statsSeries
+	keys   []string
+}
+
+func newMatrixBuilder() *matrixBuilder {
+	return &matrixBuilder{series: make(map[string]*statsSeries)}
+}
+
+// add adds the sample with the value v at the time t to the series with the given labels.
+func (m *matrixBuilder) add(metric map[string]string, t time.Time, v any) {
+	key := seriesKey(metric)
+	s, ok := m.series[key]
+	if !ok {
+		s = &statsSeries{Metric: metric}
+		m.series[key] = s
+		m.keys = append(m.keys, key)
+	}
+	s.Values = append(s.Values, []any{float64(t.UnixMilli()) / 1e3, v})
+}
+
+// response returns the matrix response with the collected series sorted by labels and their samples sorted by time.
+func (m *matrixBuilder) response() statsResponse {
+	sort.Strings(m.keys)
+	resp := statsResponse{Status: "success", Data: statsData{ResultType: "matrix", Result: make([]statsSeries, 0, len(m.keys))}}
+	for _, key := range m.keys {
+		s := m.series[key]
+		sort.SliceStable(s.Values, func(i, j int) bool {
+			return s.Values[i][0].(float64) < s.Values[j][0].(float64)
+		})
+		resp.Data.Result = append(resp.Data.Result, *s)
+	}
+	return resp
+}
+
+// queryStatsAt returns the result of the stats query evaluated at the time t.
+func (a *API) queryStatsAt(ctx context.Context, qi *logsql.QueryInfo, t time.Time, params RequestParams) (*statsResponse, error) {
+	logsQL, err := qi.LogsQLAt(t)
+	if err != nil {
+		return nil, err
+	}
+	body, err := a.queryStats(ctx, logsQL, t, params)
+	if err != nil {
+		return nil, err
+	}
+	var resp statsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &APIError{
+			Code:    http.StatusBadGateway,
+			Message: "failed to parse stats query response",
+			Err:     err,
+		}
+	}
+	return &resp, nil
+}
+
+// seriesKey returns the key identifying the series with the given labels.
+func seriesKey(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(strconv.Quote(name))
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(metric[name]))
+		sb.WriteString(",")
+	}
+	return sb.String()
+}
+
+func statsSample(t time.Time, v float64) []any {
+	return []any{float64(t.UnixMilli()) / 1e3, strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+// parseTime parses RFC3339 or unix timestamp the same way as VictoriaLogs does. defaultTime is returned for an empty timestamp.
+func parseTime(s string, defaultTime time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return defaultTime, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		abs := math.Abs(f)
+		switch {
+		case abs < 1e10:
+			return time.UnixMilli(int64(math.Round(f * 1e3))), nil
+		case abs < 1e13:
+			return time.UnixMilli(int64(f)), nil
+		case abs < 1e16:
+			return time.UnixMicro(int64(f)), nil
+		default:
+			return time.Unix(0, int64(f)), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, &APIError{
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("cannot parse timestamp %q", s),
+			Err:     err,
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,119 @@
+package vlogs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamFieldsCacheTTL is the duration stream field names of an endpoint are cached for.
+const streamFieldsCacheTTL = time.Minute
+
+// streamFieldsLookupWindow is the time range stream field names are looked up over if the request has no time range.
+const streamFieldsLookupWindow = time.Hour
+
+// streamFieldNamesResponse is the response of the VictoriaLogs /select/logsql/stream_field_names endpoint.
+type streamFieldNamesResponse struct {
+	Values []struct {
+		Value string `json:"value"`
+		Hits  uint64 `json:"hits"`
+	} `json:"values"`
+}
+
+type streamFieldsCacheEntry struct {
+	fields  []string
+	expires time.Time
+}
+
+// streamFieldsCacheKey identifies stream field names looked up at the endpoint over the time range.
+type streamFieldsCacheKey struct {
+	ec    EndpointConfig
+	start time.Time
+	end   time.Time
+}
+
+// streamFieldsCache caches stream field names per endpoint and time range.
+type streamFieldsCache struct {
+	mu      sync.Mutex
+	entries map[streamFieldsCacheKey]streamFieldsCacheEntry
+}
+
+func (c *streamFieldsCache) get(key streamFieldsCacheKey) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.fields, true
+}
+
+func (c *streamFieldsCache) set(key streamFieldsCacheKey, fields []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[streamFieldsCacheKey]streamFieldsCacheEntry)
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = streamFieldsCacheEntry{fields: fields, expires: now.Add(streamFieldsCacheTTL)}
+}
+
+// StreamFieldNames returns the names of `_stream` fields stored in VictoriaLogs over the request time range. It returns nil if the query isn't executed.
+func (a *API) StreamFieldNames(ctx context.Context, params RequestParams) ([]string, error) {
+	rec, err := a.resolveEndpoint(params.EndpointConfig)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Endpoint == "" || strings.EqualFold(params.ExecMode, "translate") {
+		return nil, nil
+	}
+	end, err := parseTime(params.End, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseTime(params.Start, end.Add(-streamFieldsLookupWindow))
+	if err != nil {
+		return nil, err
+	}
+	// Extend the range to whole minutes, so close ranges share the cached names.
+	start = start.Truncate(time.Minute)
+	if t := end.Truncate(time.Minute); !t.Equal(end) {
+		end = t.Add(time.Minute)
+	}
+	key := streamFieldsCacheKey{ec: rec, start: start, end: end}
+	if fields, ok := a.streamFields.get(key); ok {
+		return fields, nil
+	}
+
+	form := url.Values{}
+	form.Set("query", "*")
+	form.Set("start", start.UTC().Format(time.RFC3339Nano))
+	form.Set("end", end.UTC().Format(time.RFC3339Nano))
+	body, err := a.doForm(ctx, RequestParams{EndpointConfig: rec}, "/select/logsql/stream_field_names", form)
+	if err != nil {
+		return nil, err
+	}
+	var resp streamFieldNamesResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, &APIError{
+			Code:    http.StatusBadGateway,
+			Message: "failed to parse stream field names response",
+			Err:     err,
+		}
+	}
+	fields := make([]string, 0, len(resp.Values))
+	for _, v := range resp.Values {
+		fields = append(fields, v.Value)
+	}
+	a.streamFields.set(key, fields)
+	return fields, nil
+}